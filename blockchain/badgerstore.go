@@ -0,0 +1,127 @@
+package blockchain
+
+import (
+	"github.com/dgraph-io/badger"
+)
+
+// a Store on disk, in a badger database
+type BadgerStore struct {
+	DB *badger.DB // native golang db
+}
+
+// opens (or creates) the badger database in dir
+func OpenBadgerStore(dir string) (*BadgerStore, error) {
+	opts := badger.DefaultOptions(dir) // badgerdb default options
+	opts.Dir = dir                     // where keys and metadata are stored in the db
+	opts.ValueDir = dir                // where values are stored
+
+	opts.Logger = nil // removes logging, as it cluttered the output
+
+	db, err := badger.Open(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	return &BadgerStore{db}, nil
+}
+
+func (s *BadgerStore) Get(key []byte) ([]byte, error) {
+	var value []byte
+
+	// read-only on the db
+	err := s.DB.View(func(txn *badger.Txn) error {
+		var err error
+		value, err = badgerGet(txn, key)
+		return err
+	})
+
+	return value, err
+}
+
+func (s *BadgerStore) GetBlock(hash []byte) (*Block, error) {
+	return getBlock(s.Get, hash)
+}
+
+func (s *BadgerStore) PutBlock(block *Block) error {
+	return s.Update(func(b Batch) error {
+		return b.PutBlock(block)
+	})
+}
+
+func (s *BadgerStore) GetTip() ([]byte, error) {
+	return getTip(s.Get)
+}
+
+func (s *BadgerStore) SetTip(hash []byte) error {
+	return s.Update(func(b Batch) error {
+		return b.SetTip(hash)
+	})
+}
+
+// the batch is a badger read-write transaction
+func (s *BadgerStore) Update(fn func(Batch) error) error {
+	return s.DB.Update(func(txn *badger.Txn) error {
+		return fn(badgerBatch{txn})
+	})
+}
+
+func (s *BadgerStore) IteratePrefix(prefix []byte, fn func(key, value []byte) error) error {
+	return s.DB.View(func(txn *badger.Txn) error {
+		it := txn.NewIterator(badger.DefaultIteratorOptions)
+		defer it.Close()
+
+		for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+			item := it.Item()
+			value, err := item.ValueCopy(nil)
+			if err != nil {
+				return err
+			}
+			if err := fn(item.KeyCopy(nil), value); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (s *BadgerStore) Close() error {
+	return s.DB.Close()
+}
+
+type badgerBatch struct {
+	txn *badger.Txn
+}
+
+func (b badgerBatch) Get(key []byte) ([]byte, error) {
+	return badgerGet(b.txn, key)
+}
+
+func (b badgerBatch) Set(key, value []byte) error {
+	return b.txn.Set(key, value)
+}
+
+func (b badgerBatch) Delete(key []byte) error {
+	return b.txn.Delete(key)
+}
+
+func (b badgerBatch) PutBlock(block *Block) error {
+	return putBlock(b, block)
+}
+
+func (b badgerBatch) SetTip(hash []byte) error {
+	return b.txn.Set(tipKey, hash)
+}
+
+// gets a copy of the value under key, with badger's not found
+// error turned into ours
+func badgerGet(txn *badger.Txn, key []byte) ([]byte, error) {
+	item, err := txn.Get(key)
+	if err == badger.ErrKeyNotFound {
+		return nil, ErrKeyNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return item.ValueCopy(nil)
+}
@@ -2,90 +2,161 @@ package blockchain
 
 import (
 	"bytes"
-	"crypto/sha256"
-	"encoding/gob"
-	"log"
+	"context"
+	"errors"
+	"time"
 )
 
+const blockVersion = 2 // bumped whenever the block rules change, 2 hashes without gob
+
+// the most bytes of serialized transactions a block template is filled with
+const MaxBlockSize = 1000000
+
+// the header is what the proof of work hashes. the transactions
+// themselves are only committed to through the merkle root
+type BlockHeader struct {
+	Version    int
+	PrevHash   []byte // slice of bytes
+	MerkleRoot []byte // root of the merkle tree of the block's transactions
+	Timestamp  int64  // unix time the block was created
+	Bits       int    // difficulty the block was mined at
+	Nonce      int
+	Height     int // number of blocks before this one, genesis is 0
+}
+
 type Block struct {
+	BlockHeader  // embedded, so block.PrevHash, block.Nonce etc still work
 	Hash         []byte
-	Transactions []*Transaction
-	PrevHash     []byte // slice of bytes
-	Nonce        int
+	Transactions []*Transaction // the block body
 }
 
-// use hashing to provide unique representation of combined
-// transactions
+// use a merkle tree to provide unique representation of combined
+// transactions. the root ends up in the proof of work data
 func (b *Block) HashTransactions() []byte {
-	var txHashes [][]byte
-	var txHash [32]byte
+	tree := NewMerkleTree(b.txIDs())
+
+	return tree.RootNode.Data
+}
+
+// the transaction ids are the leaves of the block's merkle tree
+func (b *Block) txIDs() [][]byte {
+	var txIDs [][]byte
 
 	for _, tx := range b.Transactions {
-		txHashes = append(txHashes, tx.ID)
+		txIDs = append(txIDs, tx.ID)
 	}
-	txHash = sha256.Sum256(bytes.Join(txHashes, []byte{}))
 
-	return txHash[:]
+	return txIDs
 }
 
-func CreateBlock(txs []*Transaction, prevHash []byte) *Block {
+// proves that the transaction with the given id is in the block
+func (b *Block) MerkleProof(txID []byte) (*MerkleProof, error) {
+	for i, tx := range b.Transactions {
+		if bytes.Equal(tx.ID, txID) {
+			return NewMerkleProof(b.txIDs(), i)
+		}
+	}
+
+	return nil, errors.New("transaction is not in the block")
+}
+
+// checks a proof made by MerkleProof against the block's merkle root,
+// without needing the block's other transactions
+func VerifyMerkleProof(merkleRoot, txID []byte, proof *MerkleProof) bool {
+	return proof.Verify(merkleRoot, txID)
+}
+
+func CreateBlock(txs []*Transaction, prevHash []byte, height, bits int) (*Block, error) {
 	// creates a new block based on a previous hash and
-	// the new block's supposed data.
-	block := &Block{[]byte{}, txs, prevHash, 0}
+	// the new block's supposed data, mined at the given difficulty.
+	block := newBlock(txs, prevHash, height, bits)
 
 	// gets the proof of work per block
-	pow := NewProof(block)
+	pow, err := NewProof(block)
+	if err != nil {
+		return nil, err
+	}
 
 	// returns nonce and hash when pow alg is run
-	nonce, hash := pow.Run()
+	nonce, hash, err := pow.Run()
+	if err != nil {
+		return nil, err
+	}
 
 	// saves these values
 	block.Hash = hash[:]
 	block.Nonce = nonce
 
-	return block
+	return block, nil
 }
 
-func Genesis(coinbase *Transaction) *Block {
-	// creates an initial "Genesis" block
-	// to start the blockchain
-	return CreateBlock([]*Transaction{coinbase}, []byte{})
-}
+// like CreateBlock, but mining stops when ctx is done.
+// returns a *MiningAbortedError if it was stopped
+func CreateBlockContext(ctx context.Context, txs []*Transaction, prevHash []byte, height, bits int, opts MiningOptions) (*Block, error) {
+	block := newBlock(txs, prevHash, height, bits)
 
-// convert data to slice of bytes
-func (b *Block) Serialize() []byte {
-	// dynamically growing buffer of bytes
-	// useful for building/manipulating strings
-	var res bytes.Buffer
-	// encoder called on our bytes buffer
-	encoder := gob.NewEncoder(&res)
-
-	// encodes our actual block, can return an error
-	err := encoder.Encode(b)
+	pow, err := NewProof(block)
+	if err != nil {
+		return nil, err
+	}
+	nonce, hash, err := pow.RunContext(ctx, opts)
+	if err != nil {
+		return nil, err
+	}
 
-	// if error occurs
-	Handle(err)
+	block.Hash = hash[:]
+	block.Nonce = nonce
 
-	return res.Bytes() // return the result in bytes
+	return block, nil
 }
 
-// converts data in bytes to a Block
-func Deserialize(data []byte) *Block {
-	var block Block // store the Block val
+// a block that hasn't been mined yet
+func newBlock(txs []*Transaction, prevHash []byte, height, bits int) *Block {
+	block := &Block{BlockHeader{blockVersion, prevHash, nil, time.Now().Unix(), bits, 0, height}, []byte{}, txs}
+	block.MerkleRoot = block.HashTransactions()
 
-	// new decoder called on the bytes, reads from the byte slice
-	decoder := gob.NewDecoder(bytes.NewReader(data))
+	return block
+}
 
-	// decodes data into the block
-	err := decoder.Decode(&block)
+func Genesis(coinbase *Transaction) (*Block, error) {
+	// creates an initial "Genesis" block
+	// to start the blockchain
+	return CreateBlock([]*Transaction{coinbase}, []byte{}, 0, initialDifficulty)
+}
 
-	Handle(err) // error handling
+// convert data to slice of bytes
+func (b *Block) Serialize() ([]byte, error) {
+	// the block is written field by field, see encoding.go
+	e := newEncoder()
+	e.block(b)
 
-	return &block // returns decoded block
+	return e.buf, nil // return the result in bytes
 }
 
-func Handle(err error) {
-	if err != nil {
-		log.Panic(err) // panic is like console.error()
+func Deserialize(data []byte) (*Block, error) {
+	var block *Block
+
+	if isCanonical(data) {
+		d := newDecoder(data)
+		block = d.block() // reads the fields back in the same order
+		if err := d.finish(); err != nil {
+			return nil, err
+		}
+	} else {
+		// written with gob before the encoding changed
+		var err error
+		block, err = legacyDeserializeBlock(data)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// the transactions of old blocks keep the old rules
+	if block.Version <= legacyBlockVersion {
+		for _, tx := range block.Transactions {
+			tx.legacy = true
+		}
 	}
+
+	return block, nil // returns decoded block
 }
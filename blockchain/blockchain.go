@@ -1,283 +1,446 @@
 package blockchain
 
 import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"encoding/binary"
 	"encoding/hex"
+	"errors"
 	"fmt"
 	"os"
-	"runtime"
-
-	"github.com/dgraph-io/badger"
 )
 
 const (
-	dbPath      = "./tmp/blocks"
-	dbFile      = "./tmp/blocks/MANIFEST" // verify blockchain db existence
 	genesisData = "First Transaction from Genesis"
 )
 
+// errors callers can check for with errors.Is
+var (
+	ErrChainNotFound       = errors.New("no existing blockchain found, create one")
+	ErrChainExists         = errors.New("blockchain already exists")
+	ErrInsufficientFunds   = errors.New("not enough funds")
+	ErrBlockNotFound       = errors.New("block not found")
+	ErrTransactionNotFound = errors.New("transaction does not exist")
+	ErrInvalidTransaction  = errors.New("invalid transaction")
+	ErrNoMoreBlocks        = errors.New("no more blocks") // an iterator has gone past its last block
+	ErrMempoolConflict     = errors.New("spends an output already spent in the mempool")
+	ErrInvalidBlock        = errors.New("invalid block")
+)
+
 type BlockChain struct {
 	LastHash []byte
-	Database *badger.DB // native golang db
-}
-
-type BlockChainIterator struct {
-	CurrentHash []byte     // the current hash (obv)
-	Database    *badger.DB // pointer to badger db
+	Database Store // where the blocks are kept
+	TxIndex  bool  // keep a txid -> block index as blocks are added
+	// how many blocks a coinbase output has to be buried under before it is spent.
+	// a rule of the chain, it is stored with it when the chain is created
+	CoinbaseMaturity int
 }
 
-func DBexists() bool {
+func DBexists(config Config) bool {
 	// if the db doesnt exist, return false, else true
-	if _, err := os.Stat(dbFile); os.IsNotExist(err) {
+	if _, err := os.Stat(config.dbFile()); os.IsNotExist(err) {
 		return false
 	}
 	return true
 }
 
-func ContinueBlockChain(address string) *BlockChain {
-	if DBexists() == false {
-		fmt.Println("No existing blockchain found, create one!")
-		runtime.Goexit()
+// opens the badger database of an existing chain
+func ContinueBlockChain(config Config, address string) (*BlockChain, error) {
+	if DBexists(config) == false {
+		return nil, ErrChainNotFound
 	}
 
-	var lastHash []byte
+	store, err := OpenBadgerStore(config.dbPath())
+	if err != nil {
+		return nil, err
+	}
 
-	opts := badger.DefaultOptions(dbPath)
-	opts.Dir = dbPath
-	opts.ValueDir = dbPath
+	chain, err := ContinueBlockChainStore(store)
+	if err != nil {
+		store.Close()
+		return nil, err
+	}
+	if config.TxIndex {
+		// a chain that had the index off gets its old blocks indexed
+		if err := chain.enableTxIndex(); err != nil {
+			store.Close()
+			return nil, err
+		}
+	}
 
-	db, err := badger.Open(opts)
-	Handle(err)
+	return chain, nil
+}
 
-	err = db.Update(func(txn *badger.Txn) error {
-		item, err := txn.Get([]byte("lh"))
-		Handle(err)
-		err = item.Value(func(val []byte) error {
-			lastHash = append([]byte{}, val...)
-			return nil
-		})
+// continues the chain kept in store
+func ContinueBlockChainStore(store Store) (*BlockChain, error) {
+	lastHash, err := store.GetTip()
+	if err != nil {
+		return nil, err
+	}
 
-		return err
-	})
-	Handle(err)
+	// a quick look at the tip, so a damaged store is noticed when it is opened
+	tip, err := store.GetBlock(lastHash)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkBlock(tip, tip.Bits); err != nil {
+		return nil, err
+	}
 
-	chain := BlockChain{lastHash, db}
+	maturity, err := getMaturity(store)
+	if err != nil {
+		return nil, err
+	}
 
-	return &chain
+	chain := BlockChain{LastHash: lastHash, Database: store, CoinbaseMaturity: maturity}
+
+	return &chain, nil
 }
 
-func InitBlockChain(address string) *BlockChain {
-	var lastHash []byte
+// the coinbase maturity stored with the chain. chains made before
+// it was stored get DefaultCoinbaseMaturity
+func getMaturity(store Store) (int, error) {
+	value, err := store.Get(maturityKey)
+	if errors.Is(err, ErrKeyNotFound) {
+		return DefaultCoinbaseMaturity, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	if len(value) != 8 || int64(binary.BigEndian.Uint64(value)) < 0 {
+		return 0, fmt.Errorf("bad coinbase maturity %x in the store", value)
+	}
+
+	return int(binary.BigEndian.Uint64(value)), nil
+}
 
+// creates a new chain in a badger database, with the genesis reward going to
+// address and the coinbase maturity of the config
+func InitBlockChain(config Config, address string) (*BlockChain, error) {
 	// checks if db exists
-	if DBexists() {
-		fmt.Println("Blockchain already exists")
-		runtime.Goexit() // exit if so
+	if DBexists(config) {
+		return nil, ErrChainExists
 	}
 
 	// create badger db
-	opts := badger.DefaultOptions(dbPath) // badgerdb default options
-	opts.Dir = dbPath                     // where keys and metadata are stored in the db
-	opts.ValueDir = dbPath                // where values are stored
+	store, err := OpenBadgerStore(config.dbPath())
+	if err != nil {
+		return nil, err
+	}
+
+	chain, err := InitBlockChainStore(store, address, config.CoinbaseMaturity)
+	if err != nil {
+		store.Close()
+		return nil, err
+	}
+
+	if config.TxIndex {
+		// the genesis block was written before the index was on
+		if err := chain.enableTxIndex(); err != nil {
+			store.Close()
+			return nil, err
+		}
+	}
+
+	return chain, nil
+}
 
-	opts.Logger = nil // removes logging, as it cluttered the output
+// creates a new chain in store, with the genesis reward going to address.
+// coinbases have to be buried under maturity blocks before they are
+// spent, 0 uses DefaultCoinbaseMaturity
+func InitBlockChainStore(store Store, address string, maturity int) (*BlockChain, error) {
+	if maturity < 0 {
+		return nil, fmt.Errorf("coinbase maturity can't be negative, got %d", maturity)
+	}
+	if maturity == 0 {
+		maturity = DefaultCoinbaseMaturity
+	}
+
+	// checks the store for a tip, if there is one the chain was already made
+	if _, err := store.GetTip(); !errors.Is(err, ErrChainNotFound) {
+		if err == nil {
+			return nil, ErrChainExists
+		}
+		return nil, err
+	}
+
+	// address of this transaction is rewarded
+	cbtx, err := CoinbaseTx(address, genesisData, 0, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	genesis, err := Genesis(cbtx)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkBlock(genesis, initialDifficulty); err != nil {
+		return nil, err
+	}
 
-	db, err := badger.Open(opts)
-	Handle(err) // handles db errs
+	chain := BlockChain{LastHash: genesis.Hash, Database: store, CoinbaseMaturity: maturity}
 
 	// this func is called a "Closure"
-	// txn is a pointer to a badger transaction
-	// passes back an err
-	err = db.Update(func(txn *badger.Txn) error {
-		// checks the transaction for a lasthash key (lh),
-		// if not found, will return badget.ErrKeyNotFound
-		if _, err := txn.Get([]byte("lh")); err == badger.ErrKeyNotFound {
-			// address of this transaction is rewarded
-			cbtx := CoinbaseTx(address, genesisData)
-			genesis := Genesis(cbtx)
-			fmt.Println("Genesis created") // when the genesis is initialized
-			// txn Set puts a val into our database
-			// in this case, genesis Hash is used as the key,
-			// and the serialized genesis value is used as the val.
-			err = txn.Set(genesis.Hash, genesis.Serialize())
-			Handle(err)
-			// the lh key is used to store the genesisHash value
-			err = txn.Set([]byte("lh"), genesis.Hash)
-
-			lastHash = genesis.Hash
+	// b is a batch of writes that are saved together
+	err = store.Update(func(b Batch) error {
+		// the genesis Hash is used as the key,
+		// and the serialized genesis value is used as the val.
+		if err := b.PutBlock(genesis); err != nil {
+			return err
+		}
+		if err := chain.indexBlock(b, genesis); err != nil {
 			return err
-		} else {
-			item, err := txn.Get([]byte("lh")) // gets the  lastHash from the db
-			Handle(err)
-			err = item.Value(func(val []byte) error {
-				lastHash = append([]byte(nil), val...)
-				return nil
-			})
-			// gets the value of the item with the key of lh
+		}
+		// the maturity is a rule of this chain, every later run has to use it
+		if err := b.Set(maturityKey, ToHex(int64(maturity))); err != nil {
+			return err
+		}
+		// the genesis reward goes into the utxo set
+		utxo := UTXOSet{&chain}
+		if err := utxo.update(b, genesis); err != nil {
 			return err
 		}
+		// the tip points at the genesis block
+		return b.SetTip(genesis.Hash)
 	})
+	if err != nil {
+		return nil, err
+	}
 
-	Handle(err)
+	return &chain, nil
+}
 
-	// blockchain created with the lastHash and pointer to db
-	blockchain := BlockChain{lastHash, db}
-	return &blockchain
+func (chain *BlockChain) AddBlock(transactions []*Transaction) error {
+	return chain.AddBlockContext(context.Background(), transactions, MiningOptions{})
 }
 
-func (chain *BlockChain) AddBlock(transactions []*Transaction) {
-	var lastHash []byte
+// like AddBlock, but mining stops when ctx is done. nothing is
+// written and a *MiningAbortedError is returned if it was stopped
+func (chain *BlockChain) AddBlockContext(ctx context.Context, transactions []*Transaction, opts MiningOptions) error {
+	lastHash, err := chain.Database.GetTip() // get the lastHash from the db
+	if err != nil {
+		return err
+	}
 
-	// read-only type transaction, takes in a closure
-	// with the txn pointer. returns an error.
-	err := chain.Database.View(func(txn *badger.Txn) error {
-		item, err := txn.Get([]byte("lh")) // get the lastHash from the db
-		Handle(err)                        // handle a potential err
-		err = item.Value(func(val []byte) error {
-			lastHash = append([]byte(nil), val...)
-			return nil
-		}) // unwrap the value and store it in lasthash
+	lastBlock, err := chain.getBlock(lastHash) // the new block goes one above it
+	if err != nil {
+		return err
+	}
 
-		return err // return a potential error
-	})
+	// refuse to mine a block with unsigned, badly signed or double spending
+	// transactions. a transaction may spend outputs of the ones before it in the block
+	height := lastBlock.Height + 1
+	if _, err := chain.validateTransactions(transactions, height); err != nil {
+		return err
+	}
 
-	Handle(err)
+	bits, err := chain.RequiredBits(height, lastHash) // the difficulty may have been retargeted
+	if err != nil {
+		return err
+	}
 
-	newBlock := CreateBlock(transactions, lastHash)
+	newBlock, err := CreateBlockContext(ctx, transactions, lastHash, height, bits, opts)
 	// creates a new block with our data and the lastHash value
-
-	err = chain.Database.Update(func(txn *badger.Txn) error {
-		// hash is used as key, serialized newBlock used as value
-		err := txn.Set(newBlock.Hash, newBlock.Serialize())
-		Handle(err)
-		err = txn.Set([]byte("lh"), newBlock.Hash) // set hash val to "lh" key
-
-		chain.LastHash = newBlock.Hash
-		// make the lastHash the current hash, for the next block
-
+	if err != nil {
 		return err
-	})
-	Handle(err)
-}
-
-func (chain *BlockChain) Iterator() *BlockChainIterator {
-	// creates a BlockChainIterator by getting the chain's
-	// lastHash and the pointer to its Database
-	iter := &BlockChainIterator{chain.LastHash, chain.Database}
-
-	return iter // returns this new iterator
-} // iterates through the newest block to the genesis
+	}
 
-func (iter *BlockChainIterator) Next() *Block {
-	var block *Block
+	return chain.AcceptBlock(newBlock)
+}
 
-	// read-only on the db
-	err := iter.Database.View(func(txn *badger.Txn) error {
-		// gets the item with the currenthash
-		item, _ := txn.Get(iter.CurrentHash)
-		// get a byte representation of our block + an error
-		err := item.Value(func(encodedBlock []byte) error {
-			block = Deserialize(encodedBlock)
-			return nil
-		}) // Deserialize the encodedblock to create a new block
+// validates a mined block and adds it on top of the tip
+func (chain *BlockChain) AcceptBlock(newBlock *Block) error {
+	if err := chain.ValidateBlock(newBlock); err != nil {
+		return err
+	}
 
+	// the mempool drops the transactions the block confirms
+	pool := Mempool{chain}
+	pending, err := pool.Transactions()
+	if err != nil {
 		return err
+	}
+
+	err = chain.Database.Update(func(b Batch) error {
+		// hash is used as key, serialized newBlock used as value
+		if err := b.PutBlock(newBlock); err != nil {
+			return err
+		}
+		if err := chain.indexBlock(b, newBlock); err != nil {
+			return err
+		}
+		// the utxo set is updated in the same batch
+		utxo := UTXOSet{chain}
+		if err := utxo.update(b, newBlock); err != nil {
+			return err
+		}
+		if err := pool.update(b, newBlock, pending); err != nil {
+			return err
+		}
+		return b.SetTip(newBlock.Hash) // the new block is the tip
 	})
-	Handle(err)
+	if err != nil {
+		return err
+	}
 
-	// keep going backwards by getting the prev hash.
-	// like traversing through a linked list
-	iter.CurrentHash = block.PrevHash
+	chain.LastHash = newBlock.Hash
+	// make the lastHash the current hash, for the next block
 
-	return block
+	return nil
 }
 
-// unspent transactions - transactions that have outputs not referenced by other inputs
+// reads the block with the given hash out of the db
+func (chain *BlockChain) getBlock(hash []byte) (*Block, error) {
+	return chain.Database.GetBlock(hash)
+}
 
-func (chain *BlockChain) FindUnspentTransactions(address string) []Transaction {
-	var unspentTxs []Transaction // arr of transactions
+// unspent transactions - transactions that have outputs not referenced by other inputs
 
-	spentTXOs := make(map[string][]int) // mapped string key with val of slice int
+// walks the whole chain and returns every unspent output, keyed by hex encoded txID.
+// used to build the utxo set from scratch
+func (chain *BlockChain) FindUTXO() (map[string]TxOutputs, error) {
+	UTXO := make(map[string]TxOutputs)  // txID -> unspent outputs
+	spentTXOs := make(map[string][]int) // txID -> indexes of outputs spent by later inputs
 
 	iter := chain.Iterator() // iterate thru blockchain
 
 	for {
-		block := iter.Next() // get block from db
+		block, err := iter.Next() // get block from db
+		if errors.Is(err, ErrNoMoreBlocks) {
+			break // went past the genesis block
+		}
+		if err != nil {
+			return nil, err
+		}
 
-		for _, tx := range block.Transactions { // iterate through transactions
+		// go through the block's transactions backwards, since a transaction
+		// can spend an output of one earlier in the same block
+		for i := len(block.Transactions) - 1; i >= 0; i-- {
+			tx := block.Transactions[i]
 			txID := hex.EncodeToString(tx.ID)
 
 		Outputs:
 			for outIdx, out := range tx.Outputs { // iterate thru transaction
-				if spentTXOs[txID] != nil { // if the map with a specific txID exists
-					for _, spentOut := range spentTXOs[txID] { // iterate thru that map
-						if spentOut == outIdx { // is the spentOut index equal to the output index
-							continue Outputs // continue with the outputs for loop
-						}
+				for _, spentOut := range spentTXOs[txID] { // iterate thru the spent outputs of this txn
+					if spentOut == outIdx { // is the spentOut index equal to the output index
+						continue Outputs // continue with the outputs for loop
 					}
 				}
-				if out.CanBeUnlocked(address) {
-					unspentTxs = append(unspentTxs, *tx)
-				} // append all transactions that can be unlocked into unspentTxs
+				outs := UTXO[txID]
+				outs.Outputs = append(outs.Outputs, out)
+				outs.Indexes = append(outs.Indexes, outIdx)
+				outs.Coinbase = tx.IsCoinbase()
+				outs.Height = block.Height
+				UTXO[txID] = outs
 			}
 
 			if tx.IsCoinbase() == false { // check if this is a coinbase transaction
 				for _, in := range tx.Inputs {
-					if in.CanUnlock(address) { // if in can unlock a specific address
-						inTxID := hex.EncodeToString(in.ID)           // encode in.ID
-						spentTXOs[inTxID] = append(spentTXOs[inTxID]) // append a spent transaction
-						// with the encoded id to spentTxos
-					}
+					inTxID := hex.EncodeToString(in.ID)                   // encode in.ID
+					spentTXOs[inTxID] = append(spentTXOs[inTxID], in.Out) // record the spent output index
 				}
 			}
 		}
-
-		if len(block.PrevHash) == 0 { // if len of block prevhash is 0, block is genesis
-			break
-		}
 	}
 
-	return unspentTxs
+	return UTXO, nil
 }
 
-func (chain *BlockChain) FindUTXO(address string) []TxOutput {
-	var UTXOs []TxOutput // array of transaction outputs
-	unspentTransactions := chain.FindUnspentTransactions(address)
-	// use our method to find unspent transaction
+// looks up the transaction with the given id
+func (chain *BlockChain) FindTransaction(ID []byte) (Transaction, error) {
+	block, pos, err := chain.LocateTransaction(ID)
+	if err != nil {
+		return Transaction{}, err
+	}
+
+	return *block.Transactions[pos], nil
+}
 
-	for _, tx := range unspentTransactions { // iterate thru unspentTransactions
-		for _, out := range tx.Outputs { // iterate thru transaction outputs
-			if out.CanBeUnlocked(address) { // check if output can be unlocked
-				UTXOs = append(UTXOs, out) // if so, append it to UTXOs
+// gets the transactions that tx's inputs reference, keyed by hex encoded id.
+// pending transactions that are not in the chain yet are searched first
+func (chain *BlockChain) prevTransactions(tx *Transaction, pending []*Transaction) (map[string]Transaction, error) {
+	prevTXs := make(map[string]Transaction)
+
+Inputs:
+	for _, in := range tx.Inputs {
+		for _, ptx := range pending {
+			if bytes.Equal(ptx.ID, in.ID) {
+				prevTXs[hex.EncodeToString(ptx.ID)] = *ptx
+				continue Inputs
 			}
 		}
+
+		prevTX, err := chain.FindTransaction(in.ID)
+		if err != nil {
+			return nil, err
+		}
+		prevTXs[hex.EncodeToString(prevTX.ID)] = prevTX
 	}
 
-	return UTXOs // return UTXOs
+	return prevTXs, nil
 }
 
-// enables us to create normal transactions, that are not coinbase transactions
-// takes in address and a specified amount, outputs an int and a map w string and int
-func (chain *BlockChain) FindSpendableOutputs(address string, amount int) (int, map[string][]int) {
-	unspentOuts := make(map[string][]int)
-	unspentTxs := chain.FindUnspentTransactions(address) // finds unspent txns
-	accumulated := 0
-
-Work:
-	for _, tx := range unspentTxs { // iterates thru unspent transactions
-		txID := hex.EncodeToString(tx.ID) // get tx id. and encode into string
-
-		for outIdx, out := range tx.Outputs { // iterate thru outputs
-			if out.CanBeUnlocked(address) && accumulated < amount { // can output be unlocked,
-				// and is the accumulated less than the amnt we want to send
-				accumulated += out.Value
-				unspentOuts[txID] = append(unspentOuts[txID], outIdx) // append new outIdx to unspentOuts
-
-				if accumulated >= amount { // if accumulated is greater or equal to amount, break
-					break Work
-				}
-			}
-		}
+func (chain *BlockChain) SignTransaction(tx *Transaction, privKey ecdsa.PrivateKey) error {
+	prevTXs, err := chain.prevTransactions(tx, nil)
+	if err != nil {
+		return err
+	}
+
+	return tx.Sign(privKey, prevTXs)
+}
+
+// checks the signatures of tx against the transactions stored in the chain.
+// returns nil if they are good, or an error wrapping ErrInvalidTransaction
+func (chain *BlockChain) VerifyTransaction(tx *Transaction) error {
+	return chain.verifyTransaction(tx, nil)
+}
+
+func (chain *BlockChain) verifyTransaction(tx *Transaction, pending []*Transaction) error {
+	if tx.IsCoinbase() {
+		return nil
+	}
+
+	prevTXs, err := chain.prevTransactions(tx, pending)
+	if errors.Is(err, ErrTransactionNotFound) {
+		// spends a transaction that isn't in the chain
+		return fmt.Errorf("%w %x: %v", ErrInvalidTransaction, tx.ID, err)
+	}
+	if err != nil {
+		return err
+	}
+
+	if !tx.Verify(prevTXs) {
+		return fmt.Errorf("%w %x: bad signature", ErrInvalidTransaction, tx.ID)
+	}
+
+	// coins can't come from nowhere, the outputs are paid for by the inputs
+	fee, err := tx.Fee(prevTXs)
+	if err != nil {
+		return err
+	}
+	if fee < 0 {
+		return fmt.Errorf("%w %x: outputs are worth more than the inputs", ErrInvalidTransaction, tx.ID)
+	}
+
+	return nil
+}
+
+// the fee tx pays, its inputs minus its outputs
+func (chain *BlockChain) TransactionFee(tx *Transaction) (int, error) {
+	return chain.transactionFee(tx, nil)
+}
+
+func (chain *BlockChain) transactionFee(tx *Transaction, pending []*Transaction) (int, error) {
+	if tx.IsCoinbase() {
+		return 0, nil
+	}
+
+	prevTXs, err := chain.prevTransactions(tx, pending)
+	if err != nil {
+		return 0, err
 	}
 
-	return accumulated, unspentOuts // generate general transaction with these vals
+	return tx.Fee(prevTXs)
 }
@@ -0,0 +1,954 @@
+package blockchain
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"math"
+	"reflect"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/must108/blockchain/wallet"
+)
+
+// a chain kept in memory with a few wallets to send between
+type testChain struct {
+	chain             *BlockChain
+	alice, bob, carol *wallet.Wallet
+	genesisCoinbaseTx *Transaction
+}
+
+func newWallet(t *testing.T) *wallet.Wallet {
+	t.Helper()
+
+	w, err := wallet.MakeWallet()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return w
+}
+
+func address(w *wallet.Wallet) string {
+	return string(w.Address())
+}
+
+// a new chain whose genesis reward goes to alice. coinbases mature
+// after one block, so the tests don't have to mine ten to spend one
+func newTestChain(t *testing.T) *testChain {
+	t.Helper()
+
+	return newTestChainMaturity(t, 1)
+}
+
+func newTestChainMaturity(t *testing.T, maturity int) *testChain {
+	t.Helper()
+
+	tc := &testChain{alice: newWallet(t), bob: newWallet(t), carol: newWallet(t)}
+
+	chain, err := InitBlockChainStore(NewMemoryStore(), address(tc.alice), maturity)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { chain.Database.Close() })
+	tc.chain = chain
+
+	genesis, err := chain.GetBlockByHeight(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tc.genesisCoinbaseTx = genesis.Transactions[0]
+
+	return tc
+}
+
+// a transaction paying amount from one wallet to another, made from the utxo set
+func (tc *testChain) send(t *testing.T, from, to *wallet.Wallet, amount int) *Transaction {
+	t.Helper()
+
+	tx, err := NewTransaction(from, address(to), amount, 0, &UTXOSet{tc.chain})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tx
+}
+
+// a transaction signed by from, spending output out of prevTX to to whole.
+// nothing checks it can be spent, so it can break the rules
+func (tc *testChain) spend(t *testing.T, from *wallet.Wallet, prevTX *Transaction, out int, to *wallet.Wallet) *Transaction {
+	t.Helper()
+
+	return tc.spendTo(t, from, prevTX, out, []TxOutput{{prevTX.Outputs[out].Value, wallet.PublicKeyHash(to.PublicKey)}})
+}
+
+// like spend, with whatever outputs are given
+func (tc *testChain) spendTo(t *testing.T, from *wallet.Wallet, prevTX *Transaction, out int, outputs []TxOutput) *Transaction {
+	t.Helper()
+
+	tx := Transaction{
+		Inputs:  []TxInput{{prevTX.ID, out, nil, from.PublicKey}},
+		Outputs: outputs,
+	}
+	if err := tx.SetID(); err != nil {
+		t.Fatal(err)
+	}
+	if err := tc.chain.SignTransaction(&tx, from.PrivateKey); err != nil {
+		t.Fatal(err)
+	}
+	return &tx
+}
+
+// mines txs into a block, with the coinbase going to miner
+func (tc *testChain) mine(t *testing.T, miner *wallet.Wallet, txs ...*Transaction) *Block {
+	t.Helper()
+
+	height, err := tc.chain.GetBestHeight()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cbTx, err := CoinbaseTx(address(miner), "", height+1, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := tc.chain.AddBlock(append([]*Transaction{cbTx}, txs...)); err != nil {
+		t.Fatal(err)
+	}
+
+	block, err := tc.chain.GetBlockByHeight(height + 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return block
+}
+
+func (tc *testChain) balance(t *testing.T, w *wallet.Wallet) int {
+	t.Helper()
+
+	mature, immature, err := UTXOSet{tc.chain}.Balance(wallet.PublicKeyHash(w.PublicKey))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return mature + immature
+}
+
+func (tc *testChain) checkBalances(t *testing.T, alice, bob, carol int) {
+	t.Helper()
+
+	for _, c := range []struct {
+		name string
+		w    *wallet.Wallet
+		want int
+	}{{"alice", tc.alice, alice}, {"bob", tc.bob, bob}, {"carol", tc.carol, carol}} {
+		if got := tc.balance(t, c.w); got != c.want {
+			t.Errorf("balance of %s is %d, want %d", c.name, got, c.want)
+		}
+	}
+}
+
+// a multi block chain where every spend uses the change or payment of the one before
+func TestChainedSpends(t *testing.T) {
+	tc := newTestChain(t)
+	tc.checkBalances(t, 100, 0, 0)
+
+	// alice pays bob 30 out of the genesis reward, carol mines
+	tx1 := tc.send(t, tc.alice, tc.bob, 30)
+	tc.mine(t, tc.carol, tx1)
+	tc.checkBalances(t, 70, 30, 100)
+
+	// bob pays carol 10 out of what alice sent him
+	tx2 := tc.send(t, tc.bob, tc.carol, 10)
+	if !bytes.Equal(tx2.Inputs[0].ID, tx1.ID) || tx2.Inputs[0].Out != 0 {
+		t.Fatalf("bob spent %x:%d, want the output alice sent %x:0", tx2.Inputs[0].ID, tx2.Inputs[0].Out, tx1.ID)
+	}
+	tc.mine(t, tc.carol, tx2)
+	tc.checkBalances(t, 70, 20, 210)
+
+	// alice spends her change, carol spends a coinbase and bob's payment
+	tx3 := tc.send(t, tc.alice, tc.bob, 70)
+	tx4 := tc.send(t, tc.carol, tc.alice, 205)
+	tc.mine(t, tc.bob, tx3, tx4)
+	tc.checkBalances(t, 205, 190, 5)
+
+	// every coin made by a block is still around, none twice
+	total, err := UTXOSet{tc.chain}.TotalValue()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if total != 400 {
+		t.Errorf("total value is %d, want 400", total)
+	}
+
+	// rebuilding the utxo set from the blocks gives the same balances
+	if err := (UTXOSet{tc.chain}).Reindex(); err != nil {
+		t.Fatal(err)
+	}
+	tc.checkBalances(t, 205, 190, 5)
+}
+
+func TestFindSpendableOutputs(t *testing.T) {
+	tc := newTestChain(t)
+	utxo := UTXOSet{tc.chain}
+	alice := wallet.PublicKeyHash(tc.alice.PublicKey)
+	bob := wallet.PublicKeyHash(tc.bob.PublicKey)
+
+	tx1 := tc.send(t, tc.alice, tc.bob, 30)
+	tc.mine(t, tc.carol, tx1)
+	tx2 := tc.send(t, tc.bob, tc.carol, 10)
+	tc.mine(t, tc.carol, tx2)
+
+	cases := []struct {
+		name       string
+		pubKeyHash []byte
+		amount     int
+		wantAcc    int
+		wantOuts   map[string][]int
+	}{
+		// the genesis output is spent, only alice's change from tx1 is left
+		{"alice everything", alice, 100, 70, map[string][]int{hex.EncodeToString(tx1.ID): {1}}},
+		{"alice a little", alice, 1, 70, map[string][]int{hex.EncodeToString(tx1.ID): {1}}},
+		// bob's 30 from tx1 is spent, only his change from tx2 is left
+		{"bob", bob, 15, 20, map[string][]int{hex.EncodeToString(tx2.ID): {1}}},
+		{"bob too much", bob, 25, 20, map[string][]int{hex.EncodeToString(tx2.ID): {1}}},
+	}
+
+	for _, c := range cases {
+		acc, outs, err := utxo.FindSpendableOutputs(c.pubKeyHash, c.amount)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if acc != c.wantAcc || !reflect.DeepEqual(outs, c.wantOuts) {
+			t.Errorf("%s: got %d %v, want %d %v", c.name, acc, outs, c.wantAcc, c.wantOuts)
+		}
+	}
+
+	// more than bob has is refused before anything is signed
+	_, err := NewTransaction(tc.bob, address(tc.carol), 25, 0, &utxo)
+	if !errors.Is(err, ErrInsufficientFunds) {
+		t.Errorf("sending more than the balance: got %v, want ErrInsufficientFunds", err)
+	}
+}
+
+// the outputs spent by a block are recorded, so they can't be spent again
+func TestSpentOutputsAreRecorded(t *testing.T) {
+	tc := newTestChain(t)
+
+	tc.mine(t, tc.carol, tc.send(t, tc.alice, tc.bob, 30))
+
+	// walking the chain finds the genesis output spent
+	UTXO, err := tc.chain.FindUTXO()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := UTXO[hex.EncodeToString(tc.genesisCoinbaseTx.ID)]; ok {
+		t.Error("FindUTXO still holds the spent genesis output")
+	}
+
+	// alice signs a second spend of the genesis output
+	tx := tc.spend(t, tc.alice, tc.genesisCoinbaseTx, 0, tc.bob)
+
+	cbTx, err := CoinbaseTx(address(tc.carol), "", 2, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := tc.chain.AddBlock([]*Transaction{cbTx, tx}); !errors.Is(err, ErrInvalidTransaction) {
+		t.Errorf("double spend: got %v, want ErrInvalidTransaction", err)
+	}
+	tc.checkBalances(t, 70, 30, 100)
+}
+
+// only the owner of an output can spend it, with a signature from their key
+func TestSignatures(t *testing.T) {
+	tc := newTestChain(t)
+
+	// alice's key on the input, signed by bob
+	wrongKey := tc.spend(t, tc.alice, tc.genesisCoinbaseTx, 0, tc.bob)
+	if err := tc.chain.SignTransaction(wrongKey, tc.bob.PrivateKey); err != nil {
+		t.Fatal(err)
+	}
+
+	unsigned := tc.spend(t, tc.alice, tc.genesisCoinbaseTx, 0, tc.bob)
+	unsigned.Inputs[0].Signature = nil
+
+	// signed by alice, claiming bob's key. the id is made again,
+	// so only the signature check can catch it
+	swapped := tc.spend(t, tc.alice, tc.genesisCoinbaseTx, 0, tc.bob)
+	swapped.Inputs[0].PubKey = tc.bob.PublicKey
+	if err := swapped.SetID(); err != nil {
+		t.Fatal(err)
+	}
+
+	txs := map[string]*Transaction{
+		"signed by the wrong key": wrongKey,
+		"unsigned":                unsigned,
+		"swapped public key":      swapped,
+	}
+	for name, tx := range txs {
+		if err := tc.chain.VerifyTransaction(tx); !errors.Is(err, ErrInvalidTransaction) {
+			t.Errorf("%s: VerifyTransaction got %v, want ErrInvalidTransaction", name, err)
+		}
+
+		cbTx, err := CoinbaseTx(address(tc.carol), "", 1, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := tc.chain.AddBlock([]*Transaction{cbTx, tx}); !errors.Is(err, ErrInvalidTransaction) {
+			t.Errorf("%s: block got %v, want ErrInvalidTransaction", name, err)
+		}
+	}
+
+	tc.checkBalances(t, 100, 0, 0)
+}
+
+func TestMerkleProof(t *testing.T) {
+	tc := newTestChain(t)
+	tc.mine(t, tc.carol)
+
+	// three transactions, so one level pairs a hash with itself
+	block := tc.mine(t, tc.carol, tc.send(t, tc.alice, tc.bob, 30), tc.send(t, tc.carol, tc.bob, 20))
+
+	for _, tx := range block.Transactions {
+		proof, err := block.MerkleProof(tx.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !VerifyMerkleProof(block.MerkleRoot, tx.ID, proof) {
+			t.Errorf("proof for %x doesn't verify", tx.ID)
+		}
+		if VerifyMerkleProof(block.MerkleRoot, tc.genesisCoinbaseTx.ID, proof) {
+			t.Errorf("proof for %x verifies another transaction", tx.ID)
+		}
+	}
+
+	if _, err := block.MerkleProof(tc.genesisCoinbaseTx.ID); err == nil {
+		t.Error("got a proof for a transaction that isn't in the block")
+	}
+	if VerifyMerkleProof(block.MerkleRoot, block.Transactions[0].ID, nil) {
+		t.Error("a nil proof verifies")
+	}
+
+	// the first two leaf hashes joined together hash to their parent,
+	// so with the rest of the proof they would reach the root
+	proof, err := block.MerkleProof(block.Transactions[0].ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	forged := append(NewMerkleNode(nil, nil, block.Transactions[0].ID).Data, proof.Steps[0].Hash...)
+	if VerifyMerkleProof(block.MerkleRoot, forged, &MerkleProof{proof.Steps[1:]}) {
+		t.Error("two joined leaf hashes verify as a transaction")
+	}
+}
+
+// a header claiming a difficulty out of range is an invalid block, not a panic
+func TestTamperedBits(t *testing.T) {
+	for _, bits := range []int{-1, 0, 256, 300} {
+		tc := newTestChain(t)
+		tc.mine(t, tc.carol)
+		tip := tc.mine(t, tc.carol)
+
+		tip.Bits = bits
+		if err := tc.chain.Database.PutBlock(tip); err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := ContinueBlockChainStore(tc.chain.Database); !errors.Is(err, ErrInvalidBlock) {
+			t.Errorf("bits %d: opening the chain got %v, want ErrInvalidBlock", bits, err)
+		}
+
+		var verifyErr *VerifyError
+		if _, err := tc.chain.VerifyChain(VerifyHeaders); !errors.As(err, &verifyErr) || !errors.Is(err, ErrInvalidBlock) || verifyErr.Height != 2 {
+			t.Errorf("bits %d: verifying got %v, want an invalid block at height 2", bits, err)
+		}
+
+		if _, err := NewProof(tip); !errors.Is(err, ErrInvalidBlock) {
+			t.Errorf("bits %d: NewProof got %v, want ErrInvalidBlock", bits, err)
+		}
+	}
+}
+
+// a chain made before the height and address indexes gets them back from ReindexBlocks
+func TestReindexBlocks(t *testing.T) {
+	tc := newTestChain(t)
+	tc.mine(t, tc.carol, tc.send(t, tc.alice, tc.bob, 30))
+	tc.mine(t, tc.carol)
+	bob := wallet.PublicKeyHash(tc.bob.PublicKey)
+
+	utxo := UTXOSet{tc.chain}
+	for _, prefix := range [][]byte{heightPrefix, addrPrefix} {
+		if err := utxo.DeleteByPrefix(prefix); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := tc.chain.GetBlockByHeight(1); !errors.Is(err, ErrBlockNotFound) {
+		t.Fatalf("without the index got %v, want ErrBlockNotFound", err)
+	}
+
+	if err := tc.chain.ReindexBlocks(); err != nil {
+		t.Fatal(err)
+	}
+
+	for height := 0; height <= 2; height++ {
+		block, err := tc.chain.GetBlockByHeight(height)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if block.Height != height {
+			t.Errorf("height %d holds the block at %d", height, block.Height)
+		}
+	}
+	if _, err := tc.chain.VerifyChain(VerifyUTXO); err != nil {
+		t.Error(err)
+	}
+
+	entries, err := tc.chain.History(bob, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].Received != 30 {
+		t.Errorf("bob's history is %v, want one entry receiving 30", entries)
+	}
+}
+
+// opening a chain with -txindex indexes the blocks added while it was off
+func TestTxIndexBackfill(t *testing.T) {
+	config := Config{DataDir: t.TempDir(), CoinbaseMaturity: 1}
+	tc := &testChain{alice: newWallet(t), bob: newWallet(t), carol: newWallet(t)}
+
+	// opens the chain, with or without the index
+	open := func(txIndex bool) {
+		t.Helper()
+		config.TxIndex = txIndex
+
+		chain, err := ContinueBlockChain(config, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		tc.chain = chain
+	}
+	// whether every transaction of the chain has an entry in the index
+	indexed := func() bool {
+		t.Helper()
+		UTXO, err := tc.chain.FindUTXO()
+		if err != nil {
+			t.Fatal(err)
+		}
+		for id := range UTXO {
+			ID, err := hex.DecodeString(id)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := tc.chain.Database.Get(txKey(ID)); errors.Is(err, ErrKeyNotFound) {
+				return false
+			} else if err != nil {
+				t.Fatal(err)
+			}
+		}
+		return true
+	}
+
+	chain, err := InitBlockChain(config, address(tc.alice))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tc.chain = chain
+	tc.mine(t, tc.carol, tc.send(t, tc.alice, tc.bob, 30))
+	if indexed() {
+		t.Error("transactions were indexed with the index off")
+	}
+	tc.chain.Database.Close()
+
+	open(true)
+	if !indexed() {
+		t.Error("turning the index on didn't index the old blocks")
+	}
+	tc.chain.Database.Close()
+
+	// a block added with the index off again is indexed the next time it is on
+	open(false)
+	tc.mine(t, tc.bob, tc.send(t, tc.bob, tc.carol, 10))
+	tc.chain.Database.Close()
+
+	open(true)
+	defer tc.chain.Database.Close()
+	if !indexed() {
+		t.Error("a block added with the index off wasn't indexed")
+	}
+}
+
+func TestHistoryPaging(t *testing.T) {
+	tc := newTestChain(t)
+	tx1 := tc.send(t, tc.alice, tc.bob, 30)
+	tc.mine(t, tc.carol, tx1)
+	tx2 := tc.send(t, tc.alice, tc.bob, 20)
+	tc.mine(t, tc.carol, tx2)
+	alice := wallet.PublicKeyHash(tc.alice.PublicKey)
+
+	// newest first: tx2, tx1, then the genesis coinbase
+	want := [][]byte{tx2.ID, tx1.ID, tc.genesisCoinbaseTx.ID}
+	cases := []struct{ skip, limit, from, to int }{
+		{0, 0, 0, 3},
+		{0, 2, 0, 2},
+		{1, 1, 1, 2},
+		{2, 5, 2, 3},
+		{3, 1, 3, 3},
+		{10, 0, 3, 3},
+	}
+
+	for _, c := range cases {
+		entries, err := tc.chain.History(alice, c.skip, c.limit)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(entries) != c.to-c.from {
+			t.Errorf("skip %d limit %d: got %d entries, want %d", c.skip, c.limit, len(entries), c.to-c.from)
+			continue
+		}
+		for i, entry := range entries {
+			if !bytes.Equal(entry.Transaction.ID, want[c.from+i]) {
+				t.Errorf("skip %d limit %d: entry %d is %x, want %x", c.skip, c.limit, i, entry.Transaction.ID, want[c.from+i])
+			}
+		}
+	}
+
+	for _, bad := range [][2]int{{-1, 0}, {0, -1}, {-5, -5}} {
+		if _, err := tc.chain.History(alice, bad[0], bad[1]); err == nil {
+			t.Errorf("skip %d limit %d: got no error", bad[0], bad[1])
+		}
+	}
+}
+
+// the maturity is kept with the chain, and holds for the genesis coinbase too
+func TestCoinbaseMaturity(t *testing.T) {
+	if _, err := InitBlockChainStore(NewMemoryStore(), address(newWallet(t)), -1); err == nil {
+		t.Error("created a chain with a negative maturity")
+	}
+
+	tc := newTestChainMaturity(t, 3)
+
+	reopened, err := ContinueBlockChainStore(tc.chain.Database)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reopened.CoinbaseMaturity != 3 {
+		t.Fatalf("reopened chain has maturity %d, want 3", reopened.CoinbaseMaturity)
+	}
+
+	// the genesis coinbase can't be spent until height 3
+	alice := wallet.PublicKeyHash(tc.alice.PublicKey)
+	for height := 1; height < 3; height++ {
+		mature, immature, err := UTXOSet{tc.chain}.Balance(alice)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if mature != 0 || immature != 100 {
+			t.Errorf("before height %d alice has %d mature and %d immature, want 0 and 100", height, mature, immature)
+		}
+		if _, err := NewTransaction(tc.alice, address(tc.bob), 30, 0, &UTXOSet{tc.chain}); !errors.Is(err, ErrInsufficientFunds) {
+			t.Errorf("spending the genesis coinbase at height %d: got %v, want ErrInsufficientFunds", height, err)
+		}
+
+		cbTx, err := CoinbaseTx(address(tc.carol), "", height, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tx := tc.spend(t, tc.alice, tc.genesisCoinbaseTx, 0, tc.bob)
+		if err := tc.chain.AddBlock([]*Transaction{cbTx, tx}); !errors.Is(err, ErrInvalidTransaction) {
+			t.Errorf("block spending the genesis coinbase at height %d: got %v, want ErrInvalidTransaction", height, err)
+		}
+
+		tc.mine(t, tc.carol)
+	}
+
+	tc.mine(t, tc.carol, tc.send(t, tc.alice, tc.bob, 30))
+	tc.checkBalances(t, 70, 30, 300)
+}
+
+// outputs can't be negative or add up past the largest int,
+// or coins could be made out of nothing
+func TestOutputValues(t *testing.T) {
+	tc := newTestChain(t)
+	alice := wallet.PublicKeyHash(tc.alice.PublicKey)
+	bob := wallet.PublicKeyHash(tc.bob.PublicKey)
+	carol := wallet.PublicKeyHash(tc.carol.PublicKey)
+
+	txs := map[string][]TxOutput{
+		"negative output": {{-1000, bob}, {1100, alice}},
+		"overflow":        {{math.MaxInt, bob}, {2, alice}},
+	}
+	for name, outputs := range txs {
+		tx := tc.spendTo(t, tc.alice, tc.genesisCoinbaseTx, 0, outputs)
+
+		cbTx, err := CoinbaseTx(address(tc.carol), "", 1, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := tc.chain.AddBlock([]*Transaction{cbTx, tx}); !errors.Is(err, ErrInvalidTransaction) {
+			t.Errorf("%s: block got %v, want ErrInvalidTransaction", name, err)
+		}
+		if err := (Mempool{tc.chain}).Add(tx); !errors.Is(err, ErrInvalidTransaction) {
+			t.Errorf("%s: mempool got %v, want ErrInvalidTransaction", name, err)
+		}
+	}
+
+	coinbases := map[string][]TxOutput{
+		"negative coinbase output": {{-1000, bob}, {1100, carol}},
+		"coinbase overflow":        {{math.MaxInt, carol}, {2, carol}},
+	}
+	for name, outputs := range coinbases {
+		cbTx := &Transaction{Inputs: []TxInput{{[]byte{}, -1, nil, []byte(name)}}, Outputs: outputs}
+		if err := cbTx.SetID(); err != nil {
+			t.Fatal(err)
+		}
+		if err := tc.chain.AddBlock([]*Transaction{cbTx}); err == nil {
+			t.Errorf("%s: block was accepted", name)
+		}
+	}
+
+	tc.checkBalances(t, 100, 0, 0)
+	if _, err := tc.chain.VerifyChain(VerifyUTXO); err != nil {
+		t.Error(err)
+	}
+}
+
+// a transaction can't take the id of another one, whether it lies
+// about its id or really hashes to the id of an unspent transaction
+func TestTransactionIDs(t *testing.T) {
+	tc := newTestChain(t)
+	carolCbTx := tc.mine(t, tc.carol).Transactions[0]
+
+	// alice's spend posing as carol's coinbase would replace its outputs
+	tx := tc.send(t, tc.alice, tc.bob, 30)
+	tx.ID = carolCbTx.ID
+	cbTx, err := CoinbaseTx(address(tc.bob), "", 2, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := tc.chain.AddBlock([]*Transaction{cbTx, tx}); !errors.Is(err, ErrInvalidTransaction) {
+		t.Errorf("spend with another transaction's id: got %v, want ErrInvalidTransaction", err)
+	}
+
+	forgedCbTx, err := CoinbaseTx(address(tc.bob), "", 2, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	forgedCbTx.ID = carolCbTx.ID
+	if err := tc.chain.AddBlock([]*Transaction{forgedCbTx}); !errors.Is(err, ErrInvalidTransaction) {
+		t.Errorf("coinbase with another transaction's id: got %v, want ErrInvalidTransaction", err)
+	}
+
+	// the same data, address and subsidy hash to the same id
+	first, err := CoinbaseTx(address(tc.carol), "same data", 2, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := tc.chain.AddBlock([]*Transaction{first}); err != nil {
+		t.Fatal(err)
+	}
+	second, err := CoinbaseTx(address(tc.carol), "same data", 3, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(first.ID, second.ID) {
+		t.Fatalf("the coinbases have ids %x and %x, want the same", first.ID, second.ID)
+	}
+	if err := tc.chain.AddBlock([]*Transaction{second}); !errors.Is(err, ErrInvalidTransaction) {
+		t.Errorf("repeated coinbase: got %v, want ErrInvalidTransaction", err)
+	}
+
+	tc.checkBalances(t, 100, 0, 200)
+	if _, err := tc.chain.VerifyChain(VerifyUTXO); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestMempool(t *testing.T) {
+	tc := newTestChain(t)
+	pool := Mempool{tc.chain}
+
+	// an id that isn't the hash of the transaction is refused
+	forged := tc.send(t, tc.alice, tc.bob, 30)
+	forged.ID = []byte("whatever")
+	if err := pool.Add(forged); !errors.Is(err, ErrInvalidTransaction) {
+		t.Errorf("made up id: got %v, want ErrInvalidTransaction", err)
+	}
+
+	tx := tc.send(t, tc.alice, tc.bob, 30)
+	if err := pool.Add(tx); err != nil {
+		t.Fatal(err)
+	}
+
+	// the genesis output is taken, alice has nothing left to send with
+	if _, err := NewTransaction(tc.alice, address(tc.carol), 10, 0, &UTXOSet{tc.chain}); !errors.Is(err, ErrInsufficientFunds) {
+		t.Errorf("spending a pending output: got %v, want ErrInsufficientFunds", err)
+	}
+	conflict := tc.spend(t, tc.alice, tc.genesisCoinbaseTx, 0, tc.carol)
+	if err := pool.Add(conflict); !errors.Is(err, ErrMempoolConflict) {
+		t.Errorf("conflicting spend: got %v, want ErrMempoolConflict", err)
+	}
+
+	txs, fees, err := pool.BlockTemplate(MaxBlockSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(txs) != 1 || !bytes.Equal(txs[0].ID, tx.ID) || fees != 0 {
+		t.Fatalf("template holds %d transactions and %d in fees, want just %x", len(txs), fees, tx.ID)
+	}
+
+	// mining the transaction takes it out of the mempool
+	tc.mine(t, tc.carol, txs...)
+	pending, err := pool.Transactions()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pending) != 0 {
+		t.Errorf("%d transactions still pending after mining", len(pending))
+	}
+	tc.checkBalances(t, 70, 30, 100)
+}
+
+func TestFees(t *testing.T) {
+	tc := newTestChain(t)
+	tc.mine(t, tc.carol)
+	pool := Mempool{tc.chain}
+
+	cheap, err := NewTransaction(tc.alice, address(tc.bob), 30, 5, &UTXOSet{tc.chain})
+	if err != nil {
+		t.Fatal(err)
+	}
+	dear, err := NewTransaction(tc.carol, address(tc.bob), 10, 20, &UTXOSet{tc.chain})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tx := range []*Transaction{cheap, dear} {
+		if err := pool.Add(tx); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// the best paying one goes first, and alone if only one fits
+	txs, fees, err := pool.BlockTemplate(MaxBlockSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(txs) != 2 || !bytes.Equal(txs[0].ID, dear.ID) || fees != 25 {
+		t.Fatalf("template has %d transactions starting with %x and %d in fees, want 2 starting with %x and 25", len(txs), txs[0].ID, fees, dear.ID)
+	}
+	encoded, err := dear.Serialize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	txs, fees, err = pool.BlockTemplate(len(encoded))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(txs) != 1 || !bytes.Equal(txs[0].ID, dear.ID) || fees != 20 {
+		t.Errorf("small template has %d transactions and %d in fees, want just %x and 20", len(txs), fees, dear.ID)
+	}
+
+	// the miner may take the subsidy and the fees, not a coin more
+	txs, fees, err = pool.BlockTemplate(MaxBlockSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	greedy, err := CoinbaseTx(address(tc.bob), "", 2, fees+1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := tc.chain.AddBlock(append([]*Transaction{greedy}, txs...)); !errors.Is(err, ErrInvalidBlock) {
+		t.Errorf("coinbase taking too much: got %v, want ErrInvalidBlock", err)
+	}
+	cbTx, err := CoinbaseTx(address(tc.bob), "", 2, fees)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := tc.chain.AddBlock(append([]*Transaction{cbTx}, txs...)); err != nil {
+		t.Fatal(err)
+	}
+
+	// alice 100-35, bob 30+10+100+25, carol 100-30
+	tc.checkBalances(t, 65, 165, 70)
+}
+
+func TestVerifyChain(t *testing.T) {
+	tc := newTestChain(t)
+	tc.mine(t, tc.carol, tc.send(t, tc.alice, tc.bob, 30))
+	tc.mine(t, tc.carol, tc.send(t, tc.bob, tc.carol, 10))
+
+	for level := VerifyHeaders; level <= VerifyUTXO; level++ {
+		checked, err := tc.chain.VerifyChain(level)
+		if err != nil || checked != 3 {
+			t.Errorf("level %d: checked %d blocks, %v", level, checked, err)
+		}
+	}
+
+	// a spent output put back in the utxo set is only noticed by the utxo level
+	utxo := UTXOSet{tc.chain}
+	if err := utxo.Update(&Block{Transactions: []*Transaction{tc.genesisCoinbaseTx}}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tc.chain.VerifyChain(VerifyTransactions); err != nil {
+		t.Errorf("transactions level: %v", err)
+	}
+	if _, err := tc.chain.VerifyChain(VerifyUTXO); !errors.Is(err, errUTXOMismatch) {
+		t.Errorf("utxo level got %v, want errUTXOMismatch", err)
+	}
+	if err := utxo.Reindex(); err != nil {
+		t.Fatal(err)
+	}
+
+	// changing an output keeps the header intact, but not the transaction id
+	block, err := tc.chain.GetBlockByHeight(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	block.Transactions[1].Outputs[0].Value = 90
+	if err := tc.chain.Database.PutBlock(block); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tc.chain.VerifyChain(VerifyHeaders); err != nil {
+		t.Errorf("headers level: %v", err)
+	}
+	var verifyErr *VerifyError
+	if _, err := tc.chain.VerifyChain(VerifyTransactions); !errors.As(err, &verifyErr) || verifyErr.Height != 1 || !errors.Is(err, ErrInvalidTransaction) {
+		t.Errorf("transactions level got %v, want an invalid transaction at height 1", err)
+	}
+}
+
+func TestEncoding(t *testing.T) {
+	tc := newTestChain(t)
+	tc.mine(t, tc.carol, tc.send(t, tc.alice, tc.bob, 30))
+
+	block, err := tc.chain.GetBlockByHeight(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	encoded, err := block.Serialize()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the same block always gives the same bytes, and reads back the same
+	again, err := block.Serialize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(encoded, again) {
+		t.Error("the block encoded to different bytes twice")
+	}
+	decoded, err := Deserialize(encoded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(decoded, block) {
+		t.Errorf("block changed going through the encoding:\n%+v\n%+v", decoded, block)
+	}
+
+	outs := TxOutputs{block.Transactions[1].Outputs, []int{0, 1}, false, 1}
+	encodedOuts, err := outs.Serialize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	decodedOuts, err := DeserializeOutputs(encodedOuts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(decodedOuts, outs) {
+		t.Errorf("outputs changed going through the encoding: %+v, want %+v", decodedOuts, outs)
+	}
+
+	// cut short or with bytes left over is an error, never a panic
+	for _, data := range [][]byte{encoded[:len(encoded)/2], encoded[:3], append(encoded[:len(encoded):len(encoded)], 0)} {
+		if _, err := Deserialize(data); !errors.Is(err, ErrBadEncoding) {
+			t.Errorf("%d bytes decoded with %v, want ErrBadEncoding", len(data), err)
+		}
+	}
+}
+
+// mining finds a nonce that passes Validate, reports how it is going,
+// and stops with the context
+func TestRunContext(t *testing.T) {
+	cbTx, err := CoinbaseTx(address(newWallet(t)), "", 1, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	block := newBlock([]*Transaction{cbTx}, []byte{}, 1, 8)
+	pow, err := NewProof(block)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var reports atomic.Int64
+	opts := MiningOptions{
+		Workers:          4,
+		Progress:         func(MiningProgress) { reports.Add(1) },
+		ProgressInterval: time.Millisecond,
+	}
+	nonce, hash, err := pow.RunContext(context.Background(), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reports.Load() == 0 {
+		t.Error("Progress was never called")
+	}
+	block.Nonce = nonce
+	if !pow.Validate() {
+		t.Errorf("nonce %d doesn't meet the difficulty", nonce)
+	}
+	if want := sha256.Sum256(pow.InitData(nonce)); !bytes.Equal(hash, want[:]) {
+		t.Errorf("got hash %x, want %x", hash, want)
+	}
+
+	// no nonce meets 255 bits, so only the deadline stops it
+	hard, err := NewProof(newBlock([]*Transaction{cbTx}, []byte{}, 1, maxDifficulty))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	_, _, err = hard.RunContext(ctx, MiningOptions{Workers: 2})
+	var aborted *MiningAbortedError
+	if !errors.As(err, &aborted) {
+		t.Fatalf("got %v, want a MiningAbortedError", err)
+	}
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("got %v, want it to wrap context.DeadlineExceeded", err)
+	}
+}
+
+// the subsidy halves every halvingInterval blocks, and the last
+// coins before MaxSupply end it exactly at the cap
+func TestSubsidy(t *testing.T) {
+	subsidies := map[int]int{
+		-1: 0, 0: 100, 999: 100, 1000: 50, 1999: 50, 2000: 25,
+		3000: 12, 4000: 6, 4499: 6, 4500: 0, 5000: 0, 100000: 0,
+	}
+	for height, want := range subsidies {
+		if got := Subsidy(height); got != want {
+			t.Errorf("Subsidy(%d) = %d, want %d", height, got, want)
+		}
+	}
+
+	supplies := map[int]int{
+		0: 0, 1: 100, 1000: 100000, 2000: 150000, 4000: 187000,
+		4500: MaxSupply, 5000: MaxSupply, math.MaxInt: MaxSupply,
+	}
+	for height, want := range supplies {
+		if got := IssuedSupply(height); got != want {
+			t.Errorf("IssuedSupply(%d) = %d, want %d", height, got, want)
+		}
+	}
+
+	// paying every block its subsidy issues exactly what IssuedSupply says
+	issued := 0
+	for height := 0; height <= 5000; height++ {
+		if got := IssuedSupply(height); got != issued {
+			t.Fatalf("IssuedSupply(%d) = %d, the subsidies add up to %d", height, got, issued)
+		}
+		issued += Subsidy(height)
+	}
+}
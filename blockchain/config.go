@@ -0,0 +1,58 @@
+package blockchain
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+)
+
+// environment variables used when the config isn't set explicitly
+const (
+	DataDirEnv = "BLOCKCHAIN_DATADIR"
+	NetworkEnv = "BLOCKCHAIN_NETWORK"
+	TxIndexEnv = "BLOCKCHAIN_TXINDEX"
+)
+
+// blocks a coinbase has to be buried under before its outputs can be spent
+const DefaultCoinbaseMaturity = 10
+
+const defaultDataDir = "./tmp"
+
+// where a chain lives. every network gets its own directory under
+// DataDir, so several independent chains can share one machine
+type Config struct {
+	DataDir string // root directory for chain data
+	Network string // name of the chain, empty keeps the data directly in DataDir
+	TxIndex bool   // index transactions by id as blocks are added
+	// blocks a coinbase has to be buried under before it is spent. only used
+	// when a chain is created, it is stored with the chain after that.
+	// 0 uses DefaultCoinbaseMaturity, 1 lets coinbases be spent in the next block
+	CoinbaseMaturity int
+}
+
+// the config from the environment, falling back to ./tmp
+func DefaultConfig() Config {
+	config := Config{DataDir: os.Getenv(DataDirEnv), Network: os.Getenv(NetworkEnv), CoinbaseMaturity: DefaultCoinbaseMaturity}
+	if config.DataDir == "" {
+		config.DataDir = defaultDataDir
+	}
+	// anything strconv reads as true turns the index on
+	config.TxIndex, _ = strconv.ParseBool(os.Getenv(TxIndexEnv))
+
+	return config
+}
+
+// the directory holding this network's files
+func (c Config) Dir() string {
+	return filepath.Join(c.DataDir, c.Network)
+}
+
+// the badger database directory
+func (c Config) dbPath() string {
+	return filepath.Join(c.Dir(), "blocks")
+}
+
+// badger writes a MANIFEST file when a database is created
+func (c Config) dbFile() string {
+	return filepath.Join(c.dbPath(), "MANIFEST")
+}
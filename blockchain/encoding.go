@@ -0,0 +1,254 @@
+package blockchain
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// blocks, transactions and utxo entries are stored and hashed in a binary
+// encoding of our own instead of gob, so the same value always gives the
+// same bytes. it starts with encodingMarker and the version, after that
+// integers are varints and byte slices and lists are prefixed with their length.
+// gob data never starts with a zero byte, so data written before still decodes
+const (
+	encodingMarker  = 0x00
+	encodingVersion = 1
+)
+
+// returned when data can't be decoded
+var ErrBadEncoding = errors.New("bad encoding")
+
+type encoder struct {
+	buf []byte
+}
+
+func newEncoder() *encoder {
+	return &encoder{[]byte{encodingMarker, encodingVersion}}
+}
+
+func (e *encoder) uvarint(v uint64) {
+	e.buf = binary.AppendUvarint(e.buf, v)
+}
+
+func (e *encoder) int(v int) {
+	e.buf = binary.AppendVarint(e.buf, int64(v))
+}
+
+func (e *encoder) bool(v bool) {
+	if v {
+		e.uvarint(1)
+	} else {
+		e.uvarint(0)
+	}
+}
+
+func (e *encoder) bytes(b []byte) {
+	e.uvarint(uint64(len(b)))
+	e.buf = append(e.buf, b...)
+}
+
+// reads values back in the order they were written. the first
+// error sticks, so it only has to be checked at the end
+type decoder struct {
+	data []byte
+	err  error
+}
+
+// whether data is in our encoding rather than gob
+func isCanonical(data []byte) bool {
+	return len(data) > 0 && data[0] == encodingMarker
+}
+
+func newDecoder(data []byte) *decoder {
+	d := &decoder{data: data}
+
+	if !isCanonical(data) || len(data) < 2 {
+		d.fail("missing marker")
+	} else if data[1] != encodingVersion {
+		d.fail(fmt.Sprintf("unknown version %d", data[1]))
+	} else {
+		d.data = data[2:]
+	}
+
+	return d
+}
+
+func (d *decoder) fail(reason string) {
+	if d.err == nil {
+		d.err = fmt.Errorf("%w: %s", ErrBadEncoding, reason)
+	}
+	d.data = nil
+}
+
+func (d *decoder) uvarint() uint64 {
+	v, n := binary.Uvarint(d.data)
+	if n <= 0 {
+		d.fail("bad varint")
+		return 0
+	}
+	d.data = d.data[n:]
+
+	return v
+}
+
+func (d *decoder) int() int {
+	v, n := binary.Varint(d.data)
+	if n <= 0 {
+		d.fail("bad varint")
+		return 0
+	}
+	d.data = d.data[n:]
+
+	return int(v)
+}
+
+func (d *decoder) bool() bool {
+	return d.uvarint() != 0
+}
+
+// the length of a list, every item takes at least one byte
+func (d *decoder) count() int {
+	n := d.uvarint()
+	if n > uint64(len(d.data)) {
+		d.fail("list longer than the data")
+		return 0
+	}
+
+	return int(n)
+}
+
+// a copy of the next byte slice, nil if it is empty
+func (d *decoder) bytes() []byte {
+	n := d.uvarint()
+	if n > uint64(len(d.data)) {
+		d.fail("bytes longer than the data")
+		return nil
+	}
+	if n == 0 {
+		return nil
+	}
+
+	b := append([]byte{}, d.data[:n]...)
+	d.data = d.data[n:]
+
+	return b
+}
+
+// the error, if anything went wrong or data is left over
+func (d *decoder) finish() error {
+	if d.err == nil && len(d.data) != 0 {
+		d.fail("trailing data")
+	}
+
+	return d.err
+}
+
+// the transaction without the marker and version, so blocks can hold many
+func (e *encoder) transaction(tx *Transaction) {
+	e.bytes(tx.ID)
+
+	e.uvarint(uint64(len(tx.Inputs)))
+	for _, in := range tx.Inputs {
+		e.bytes(in.ID)
+		e.int(in.Out)
+		e.bytes(in.Signature)
+		e.bytes(in.PubKey)
+	}
+
+	e.uvarint(uint64(len(tx.Outputs)))
+	for _, out := range tx.Outputs {
+		e.int(out.Value)
+		e.bytes(out.PubKeyHash)
+	}
+}
+
+func (d *decoder) transaction() *Transaction {
+	tx := Transaction{ID: d.bytes()}
+
+	for i, n := 0, d.count(); i < n; i++ {
+		tx.Inputs = append(tx.Inputs, TxInput{d.bytes(), d.int(), d.bytes(), d.bytes()})
+	}
+
+	for i, n := 0, d.count(); i < n; i++ {
+		tx.Outputs = append(tx.Outputs, TxOutput{d.int(), d.bytes()})
+	}
+
+	return &tx
+}
+
+func (e *encoder) block(b *Block) {
+	e.int(b.Version)
+	e.bytes(b.PrevHash)
+	e.bytes(b.MerkleRoot)
+	e.int(int(b.Timestamp))
+	e.int(b.Bits)
+	e.int(b.Nonce)
+	e.int(b.Height)
+	e.bytes(b.Hash)
+
+	// every transaction is prefixed with its length
+	e.uvarint(uint64(len(b.Transactions)))
+	for _, tx := range b.Transactions {
+		txEncoder := &encoder{}
+		txEncoder.transaction(tx)
+		e.bytes(txEncoder.buf)
+	}
+}
+
+func (d *decoder) block() *Block {
+	var b Block
+
+	b.Version = d.int()
+	b.PrevHash = d.bytes()
+	b.MerkleRoot = d.bytes()
+	b.Timestamp = int64(d.int())
+	b.Bits = d.int()
+	b.Nonce = d.int()
+	b.Height = d.int()
+	b.Hash = d.bytes()
+
+	for i, n := 0, d.count(); i < n; i++ {
+		txDecoder := &decoder{data: d.bytes()}
+		tx := txDecoder.transaction()
+		if err := txDecoder.finish(); err != nil {
+			d.fail(err.Error())
+		}
+		b.Transactions = append(b.Transactions, tx)
+	}
+
+	return &b
+}
+
+func (e *encoder) outputs(outs TxOutputs) {
+	e.uvarint(uint64(len(outs.Outputs)))
+	for _, out := range outs.Outputs {
+		e.int(out.Value)
+		e.bytes(out.PubKeyHash)
+	}
+
+	e.uvarint(uint64(len(outs.Indexes)))
+	for _, index := range outs.Indexes {
+		e.int(index)
+	}
+
+	e.bool(outs.Coinbase)
+	e.int(outs.Height)
+}
+
+func (d *decoder) outputs() TxOutputs {
+	var outs TxOutputs
+
+	for i, n := 0, d.count(); i < n; i++ {
+		outs.Outputs = append(outs.Outputs, TxOutput{d.int(), d.bytes()})
+	}
+
+	for i, n := 0, d.count(); i < n; i++ {
+		outs.Indexes = append(outs.Indexes, d.int())
+	}
+
+	outs.Coinbase = d.bool()
+	outs.Height = d.int()
+
+	return outs
+}
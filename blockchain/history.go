@@ -0,0 +1,93 @@
+package blockchain
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+)
+
+// one transaction in the history of an address
+type HistoryEntry struct {
+	Transaction *Transaction
+	Height      int
+	Timestamp   int64 // of the block the transaction is in
+	Received    int   // paid to the address by the outputs
+	Sent        int   // spent from the address by the inputs
+	// the outputs going somewhere other than the address
+	Counterparty []TxOutput
+}
+
+// how much the transaction changed the balance of the address
+func (e HistoryEntry) Amount() int {
+	return e.Received - e.Sent
+}
+
+// the transactions that credit or debit pubKeyHash, newest first.
+// skip entries are left out and at most limit are returned, limit 0 means all
+func (chain *BlockChain) History(pubKeyHash []byte, skip, limit int) ([]HistoryEntry, error) {
+	if skip < 0 || limit < 0 {
+		return nil, fmt.Errorf("history can't skip %d or be limited to %d entries", skip, limit)
+	}
+
+	prefix := append(append([]byte{}, addrPrefix...), pubKeyHash...)
+
+	// the keys only hold the height and position, so collect them first
+	type location struct{ height, pos int }
+	var locations []location
+
+	err := chain.Database.IteratePrefix(prefix, func(key, value []byte) error {
+		if len(key) != len(prefix)+12 {
+			return nil // a longer hash that happens to start with this one
+		}
+		height := int(binary.BigEndian.Uint64(key[len(prefix):]))
+		pos := int(binary.BigEndian.Uint32(key[len(prefix)+8:]))
+		locations = append(locations, location{height, pos})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var entries []HistoryEntry
+
+	// keys are oldest first, walk them backwards
+	for i := len(locations) - 1 - skip; i >= 0; i-- {
+		if limit > 0 && len(entries) == limit {
+			break
+		}
+
+		block, err := chain.GetBlockByHeight(locations[i].height)
+		if err != nil {
+			return nil, err
+		}
+		tx := block.Transactions[locations[i].pos]
+
+		entry := HistoryEntry{Transaction: tx, Height: block.Height, Timestamp: block.Timestamp}
+
+		for _, out := range tx.Outputs {
+			if out.IsLockedWithKey(pubKeyHash) {
+				entry.Received += out.Value
+			} else {
+				entry.Counterparty = append(entry.Counterparty, out)
+			}
+		}
+
+		if !tx.IsCoinbase() {
+			prevTXs, err := chain.prevTransactions(tx, nil)
+			if err != nil {
+				return nil, err
+			}
+			for _, in := range tx.Inputs {
+				prevOut := prevTXs[hex.EncodeToString(in.ID)].Outputs[in.Out]
+				if bytes.Equal(prevOut.PubKeyHash, pubKeyHash) {
+					entry.Sent += prevOut.Value
+				}
+			}
+		}
+
+		entries = append(entries, entry)
+	}
+
+	return entries, nil
+}
@@ -0,0 +1,243 @@
+package blockchain
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+
+	"github.com/must108/blockchain/wallet"
+)
+
+// indexes kept next to the blocks, each under its own key prefix.
+// they are written in the same batch as the block they index
+var (
+	heightPrefix = []byte("height-")
+	txPrefix     = []byte("tx-") // only written when the chain has TxIndex set
+	addrPrefix   = []byte("addr-")
+)
+
+// heights are stored big endian, so the keys sort by height
+func heightKey(height int) []byte {
+	key := make([]byte, len(heightPrefix)+8)
+	copy(key, heightPrefix)
+	binary.BigEndian.PutUint64(key[len(heightPrefix):], uint64(height))
+
+	return key
+}
+
+func txKey(ID []byte) []byte {
+	return append(append([]byte{}, txPrefix...), ID...)
+}
+
+// an address entry is the public key hash followed by the height of the
+// block and the position of the transaction in it, so the entries
+// of one address sort oldest first
+func addrKey(pubKeyHash []byte, height, pos int) []byte {
+	key := make([]byte, len(addrPrefix)+len(pubKeyHash)+12)
+	n := copy(key, addrPrefix)
+	n += copy(key[n:], pubKeyHash)
+	binary.BigEndian.PutUint64(key[n:], uint64(height))
+	binary.BigEndian.PutUint32(key[n+8:], uint32(pos))
+
+	return key
+}
+
+// adds a new block to the indexes
+func (chain *BlockChain) indexBlock(b Batch, block *Block) error {
+	if err := b.Set(heightKey(block.Height), block.Hash); err != nil {
+		return err
+	}
+	if err := indexAddresses(b, block); err != nil {
+		return err
+	}
+
+	if chain.TxIndex {
+		return indexTransactions(b, block)
+	}
+	// a block left out, the index has to be rebuilt before it is trusted
+	return b.Delete(txIndexKey)
+}
+
+// points every transaction id in the block at the block hash
+// followed by the transaction's position, 4 bytes big endian
+func indexTransactions(b Batch, block *Block) error {
+	for i, tx := range block.Transactions {
+		location := make([]byte, len(block.Hash)+4)
+		copy(location, block.Hash)
+		binary.BigEndian.PutUint32(location[len(block.Hash):], uint32(i))
+
+		if err := b.Set(txKey(tx.ID), location); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// records every transaction under the addresses it pays or spends from.
+// a transaction touching an address twice still gets one entry
+func indexAddresses(b Batch, block *Block) error {
+	for i, tx := range block.Transactions {
+		var hashes [][]byte
+
+		if !tx.IsCoinbase() {
+			for _, in := range tx.Inputs {
+				hashes = append(hashes, wallet.PublicKeyHash(in.PubKey))
+			}
+		}
+		for _, out := range tx.Outputs {
+			hashes = append(hashes, out.PubKeyHash)
+		}
+
+		for _, pubKeyHash := range hashes {
+			if err := b.Set(addrKey(pubKeyHash, block.Height, i), tx.ID); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// turns the transaction index on. the blocks added while it was
+// off are indexed first, once, the store remembers they have been
+func (chain *BlockChain) enableTxIndex() error {
+	chain.TxIndex = true
+
+	_, err := chain.Database.Get(txIndexKey)
+	if err == nil {
+		return nil // every block is in it already
+	}
+	if !errors.Is(err, ErrKeyNotFound) {
+		return err
+	}
+
+	return chain.ReindexTransactions()
+}
+
+// rebuilds the transaction index from every block in the chain, and
+// records that it is complete. enableTxIndex runs it when needed
+func (chain *BlockChain) ReindexTransactions() error {
+	iter := chain.Iterator()
+
+	for {
+		block, err := iter.Next()
+		if errors.Is(err, ErrNoMoreBlocks) {
+			break
+		}
+		if err != nil {
+			return err
+		}
+
+		// one batch per block keeps the batches small
+		err = chain.Database.Update(func(b Batch) error {
+			return indexTransactions(b, block)
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	return chain.Database.Update(func(b Batch) error {
+		return b.Set(txIndexKey, []byte{1})
+	})
+}
+
+// rebuilds the height and address indexes from every block in the chain,
+// and the transaction index too when TxIndex is set. chains made before
+// the indexes existed need this to find blocks by height
+func (chain *BlockChain) ReindexBlocks() error {
+	iter := chain.Iterator()
+
+	for {
+		block, err := iter.Next()
+		if errors.Is(err, ErrNoMoreBlocks) {
+			break
+		}
+		if err != nil {
+			return err
+		}
+
+		err = chain.Database.Update(func(b Batch) error {
+			return chain.indexBlock(b, block)
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// finds the block holding the transaction with the given id and the
+// position of the transaction in it. the tx index is used when it has
+// the id, otherwise the chain is walked from the tip
+func (chain *BlockChain) LocateTransaction(ID []byte) (*Block, int, error) {
+	location, err := chain.Database.Get(txKey(ID))
+	if err == nil && len(location) > 4 {
+		hash := location[:len(location)-4]
+		pos := int(binary.BigEndian.Uint32(location[len(location)-4:]))
+
+		block, err := chain.Database.GetBlock(hash)
+		if err != nil {
+			return nil, 0, err
+		}
+		if pos < len(block.Transactions) && bytes.Equal(block.Transactions[pos].ID, ID) {
+			return block, pos, nil
+		}
+		// a stale entry, fall back to walking the chain
+	} else if err != nil && !errors.Is(err, ErrKeyNotFound) {
+		return nil, 0, err
+	}
+
+	iter := chain.Iterator()
+
+	for {
+		block, err := iter.Next()
+		if errors.Is(err, ErrNoMoreBlocks) {
+			break
+		}
+		if err != nil {
+			return nil, 0, err
+		}
+
+		for i, tx := range block.Transactions {
+			if bytes.Equal(tx.ID, ID) {
+				return block, i, nil
+			}
+		}
+	}
+
+	return nil, 0, fmt.Errorf("%w: %x", ErrTransactionNotFound, ID)
+}
+
+func (chain *BlockChain) GetBlockByHash(hash []byte) (*Block, error) {
+	return chain.Database.GetBlock(hash)
+}
+
+func (chain *BlockChain) GetBlockByHeight(height int) (*Block, error) {
+	if height < 0 {
+		return nil, fmt.Errorf("%w: height %d", ErrBlockNotFound, height)
+	}
+
+	hash, err := chain.Database.Get(heightKey(height))
+	if errors.Is(err, ErrKeyNotFound) {
+		return nil, fmt.Errorf("%w: height %d", ErrBlockNotFound, height)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return chain.Database.GetBlock(hash)
+}
+
+// the height of the newest block
+func (chain *BlockChain) GetBestHeight() (int, error) {
+	lastBlock, err := chain.Database.GetBlock(chain.LastHash)
+	if err != nil {
+		return 0, err
+	}
+
+	return lastBlock.Height, nil
+}
@@ -0,0 +1,88 @@
+package blockchain
+
+import "fmt"
+
+// walks backwards from the tip to the genesis block
+type BlockChainIterator struct {
+	CurrentHash []byte // the current hash (obv)
+	Database    Store  // the chain's store
+}
+
+// walks forwards through the heights Height to End, using the height index
+type ForwardIterator struct {
+	Height int // the height Next returns
+	End    int // the last height returned
+	chain  *BlockChain
+}
+
+func (chain *BlockChain) Iterator() *BlockChainIterator {
+	// creates a BlockChainIterator by getting the chain's
+	// lastHash and its store
+	iter := &BlockChainIterator{chain.LastHash, chain.Database}
+
+	return iter // returns this new iterator
+} // iterates through the newest block to the genesis
+
+// returns the next block going backwards, or ErrNoMoreBlocks
+// once the genesis block has been returned
+func (iter *BlockChainIterator) Next() (*Block, error) {
+	// the genesis block has no prev hash, so there is nothing left
+	if len(iter.CurrentHash) == 0 {
+		return nil, ErrNoMoreBlocks
+	}
+
+	// gets the block with the currenthash
+	block, err := iter.Database.GetBlock(iter.CurrentHash)
+	if err != nil {
+		return nil, err
+	}
+
+	// keep going backwards by getting the prev hash.
+	// like traversing through a linked list
+	iter.CurrentHash = block.PrevHash
+
+	return block, nil
+}
+
+// iterates from the block at height up to the tip
+func (chain *BlockChain) ForwardIterator(height int) (*ForwardIterator, error) {
+	best, err := chain.GetBestHeight()
+	if err != nil {
+		return nil, err
+	}
+
+	return chain.RangeIterator(height, best)
+}
+
+// iterates over the blocks from height start to end, both included
+func (chain *BlockChain) RangeIterator(start, end int) (*ForwardIterator, error) {
+	best, err := chain.GetBestHeight()
+	if err != nil {
+		return nil, err
+	}
+
+	if start < 0 || start > best {
+		return nil, fmt.Errorf("%w: height %d", ErrBlockNotFound, start)
+	}
+	if end < start || end > best {
+		return nil, fmt.Errorf("%w: height %d", ErrBlockNotFound, end)
+	}
+
+	return &ForwardIterator{start, end, chain}, nil
+}
+
+// returns the next block going forwards, or ErrNoMoreBlocks
+// once the block at End has been returned
+func (iter *ForwardIterator) Next() (*Block, error) {
+	if iter.Height > iter.End {
+		return nil, ErrNoMoreBlocks
+	}
+
+	block, err := iter.chain.GetBlockByHeight(iter.Height)
+	if err != nil {
+		return nil, err
+	}
+	iter.Height++
+
+	return block, nil
+}
@@ -0,0 +1,54 @@
+package blockchain
+
+import (
+	"bytes"
+	"encoding/gob"
+)
+
+// blocks before blockVersion 2 were stored and hashed with gob. their
+// transactions keep the gob rules for ids and signatures, since those
+// are what they were made with, and the data still decodes until it
+// has been rewritten by BlockChain.Migrate
+const legacyBlockVersion = 1
+
+func legacyDeserializeBlock(data []byte) (*Block, error) {
+	var block Block
+
+	decoder := gob.NewDecoder(bytes.NewReader(data))
+	if err := decoder.Decode(&block); err != nil {
+		return nil, err
+	}
+
+	return &block, nil
+}
+
+func legacyDeserializeTransaction(data []byte) (Transaction, error) {
+	var transaction Transaction
+
+	decoder := gob.NewDecoder(bytes.NewReader(data))
+	err := decoder.Decode(&transaction)
+	transaction.legacy = true
+
+	return transaction, err
+}
+
+func legacyDeserializeOutputs(data []byte) (TxOutputs, error) {
+	var outputs TxOutputs
+
+	decoder := gob.NewDecoder(bytes.NewReader(data))
+	err := decoder.Decode(&outputs)
+
+	return outputs, err
+}
+
+// the gob bytes a legacy transaction was hashed over
+func legacyEncodeTransaction(tx Transaction) ([]byte, error) {
+	var encoded bytes.Buffer
+
+	encoder := gob.NewEncoder(&encoded)
+	if err := encoder.Encode(tx); err != nil {
+		return nil, err
+	}
+
+	return encoded.Bytes(), nil
+}
@@ -0,0 +1,151 @@
+package blockchain
+
+import (
+	"sort"
+	"strings"
+	"sync"
+)
+
+// a Store that only lives in memory, for tests and simulations
+// that shouldn't touch the disk
+type MemoryStore struct {
+	mu   sync.RWMutex
+	data map[string][]byte
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{data: make(map[string][]byte)}
+}
+
+func (s *MemoryStore) Get(key []byte) ([]byte, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	value, ok := s.data[string(key)]
+	if !ok {
+		return nil, ErrKeyNotFound
+	}
+
+	return append([]byte(nil), value...), nil
+}
+
+func (s *MemoryStore) GetBlock(hash []byte) (*Block, error) {
+	return getBlock(s.Get, hash)
+}
+
+func (s *MemoryStore) PutBlock(block *Block) error {
+	return s.Update(func(b Batch) error {
+		return b.PutBlock(block)
+	})
+}
+
+func (s *MemoryStore) GetTip() ([]byte, error) {
+	return getTip(s.Get)
+}
+
+func (s *MemoryStore) SetTip(hash []byte) error {
+	return s.Update(func(b Batch) error {
+		return b.SetTip(hash)
+	})
+}
+
+// the writes are collected in the batch and copied into
+// the store once fn succeeds
+func (s *MemoryStore) Update(fn func(Batch) error) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	batch := &memoryBatch{s, make(map[string][]byte), make(map[string]bool)}
+	if err := fn(batch); err != nil {
+		return err // nothing is written
+	}
+
+	for key := range batch.deletes {
+		delete(s.data, key)
+	}
+	for key, value := range batch.writes {
+		s.data[key] = value
+	}
+
+	return nil
+}
+
+func (s *MemoryStore) IteratePrefix(prefix []byte, fn func(key, value []byte) error) error {
+	s.mu.RLock()
+	var keys []string
+	for key := range s.data {
+		if strings.HasPrefix(key, string(prefix)) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys) // same order badger would give
+	s.mu.RUnlock()
+
+	for _, key := range keys {
+		value, err := s.Get([]byte(key))
+		if err == ErrKeyNotFound {
+			continue // deleted by fn
+		}
+		if err != nil {
+			return err
+		}
+		if err := fn([]byte(key), value); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (s *MemoryStore) Close() error {
+	return nil
+}
+
+// Update holds the store's lock while the batch is in use,
+// so the batch reads the map directly
+type memoryBatch struct {
+	store   *MemoryStore
+	writes  map[string][]byte
+	deletes map[string]bool
+}
+
+func (b *memoryBatch) Get(key []byte) ([]byte, error) {
+	k := string(key)
+	if value, ok := b.writes[k]; ok {
+		return append([]byte(nil), value...), nil
+	}
+	if b.deletes[k] {
+		return nil, ErrKeyNotFound
+	}
+
+	value, ok := b.store.data[k]
+	if !ok {
+		return nil, ErrKeyNotFound
+	}
+
+	return append([]byte(nil), value...), nil
+}
+
+func (b *memoryBatch) Set(key, value []byte) error {
+	k := string(key)
+	b.writes[k] = append([]byte(nil), value...)
+	delete(b.deletes, k)
+
+	return nil
+}
+
+func (b *memoryBatch) Delete(key []byte) error {
+	k := string(key)
+	b.deletes[k] = true
+	delete(b.writes, k)
+
+	return nil
+}
+
+func (b *memoryBatch) PutBlock(block *Block) error {
+	return putBlock(b, block)
+}
+
+func (b *memoryBatch) SetTip(hash []byte) error {
+	return b.Set(tipKey, hash)
+}
@@ -0,0 +1,222 @@
+package blockchain
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"sort"
+)
+
+// transactions waiting to be mined are kept in the store under this prefix,
+// so they survive between runs of the cli
+var mempoolPrefix = []byte("mempool-")
+
+// the validated transactions that aren't in a block yet. they only spend
+// outputs that are in the utxo set, and no two of them spend the same output
+type Mempool struct {
+	Blockchain *BlockChain
+}
+
+func mempoolKey(ID []byte) []byte {
+	return append(append([]byte{}, mempoolPrefix...), ID...)
+}
+
+// a string naming one output of a transaction
+func outpoint(txID []byte, out int) string {
+	return fmt.Sprintf("%x:%d", txID, out)
+}
+
+// checks tx and adds it to the mempool. a transaction spending an output
+// another one in the mempool already spends gets ErrMempoolConflict
+func (pool Mempool) Add(tx *Transaction) error {
+	// everything below looks the transaction up by its id
+	if err := checkID(tx); err != nil {
+		return err
+	}
+
+	if tx.IsCoinbase() {
+		return fmt.Errorf("%w %x: coinbase transactions are only made by miners", ErrInvalidTransaction, tx.ID)
+	}
+
+	// outputs can't be negative, or the others could pay out more than the inputs hold
+	if err := checkOutputs(tx); err != nil {
+		return err
+	}
+
+	db := pool.Blockchain.Database
+	if _, err := db.Get(mempoolKey(tx.ID)); err == nil {
+		return nil // already waiting
+	} else if !errors.Is(err, ErrKeyNotFound) {
+		return err
+	}
+
+	spent, err := pool.spentOutputs()
+	if err != nil {
+		return err
+	}
+
+	utxo := UTXOSet{pool.Blockchain}
+	seen := make(map[string]bool)
+
+	for _, in := range tx.Inputs {
+		point := outpoint(in.ID, in.Out)
+		if seen[point] {
+			return fmt.Errorf("%w %x: spends %s twice", ErrInvalidTransaction, tx.ID, point)
+		}
+		seen[point] = true
+
+		if spent[point] {
+			return fmt.Errorf("%w: %x spends %s", ErrMempoolConflict, tx.ID, point)
+		}
+
+		unspent, err := utxo.IsUnspent(in.ID, in.Out)
+		if err != nil {
+			return err
+		}
+		if !unspent {
+			return fmt.Errorf("%w %x: %s is spent or not in the chain", ErrInvalidTransaction, tx.ID, point)
+		}
+	}
+
+	// the earliest it can be mined is the next block
+	height, err := pool.Blockchain.GetBestHeight()
+	if err != nil {
+		return err
+	}
+	if err := pool.Blockchain.checkMaturity([]*Transaction{tx}, height+1); err != nil {
+		return err
+	}
+
+	// the signatures have to hold up too
+	if err := pool.Blockchain.VerifyTransaction(tx); err != nil {
+		return err
+	}
+
+	encoded, err := tx.Serialize()
+	if err != nil {
+		return err
+	}
+
+	return db.Update(func(b Batch) error {
+		return b.Set(mempoolKey(tx.ID), encoded)
+	})
+}
+
+// every transaction in the mempool, ordered by id
+func (pool Mempool) Transactions() ([]*Transaction, error) {
+	var txs []*Transaction
+
+	err := pool.Blockchain.Database.IteratePrefix(mempoolPrefix, func(_, v []byte) error {
+		tx, err := DeserializeTransaction(v)
+		if err != nil {
+			return err
+		}
+		if tx.legacy {
+			return nil // signed under the gob rules, it can't go in a new block
+		}
+		txs = append(txs, &tx)
+		return nil
+	})
+
+	return txs, err
+}
+
+// the transactions for the next block and the fees they pay. the best
+// paying ones per byte are picked until maxSize bytes are used up.
+// the mempool never holds conflicting spends, so any of them fit together
+func (pool Mempool) BlockTemplate(maxSize int) ([]*Transaction, int, error) {
+	txs, err := pool.Transactions()
+	if err != nil {
+		return nil, 0, err
+	}
+
+	type candidate struct {
+		tx   *Transaction
+		fee  int
+		size int
+	}
+	candidates := make([]candidate, 0, len(txs))
+
+	for _, tx := range txs {
+		fee, err := pool.Blockchain.TransactionFee(tx)
+		if err != nil {
+			return nil, 0, err
+		}
+		encoded, err := tx.Serialize()
+		if err != nil {
+			return nil, 0, err
+		}
+		candidates = append(candidates, candidate{tx, fee, len(encoded)})
+	}
+
+	// highest fee rate first, fee/size compared without dividing
+	sort.SliceStable(candidates, func(i, j int) bool {
+		return candidates[i].fee*candidates[j].size > candidates[j].fee*candidates[i].size
+	})
+
+	var template []*Transaction
+	fees, size := 0, 0
+
+	for _, c := range candidates {
+		if size+c.size > maxSize {
+			continue // a smaller one further down may still fit
+		}
+		template = append(template, c.tx)
+		fees += c.fee
+		size += c.size
+	}
+
+	return template, fees, nil
+}
+
+// the outputs spent by transactions in the mempool
+func (pool Mempool) spentOutputs() (map[string]bool, error) {
+	txs, err := pool.Transactions()
+	if err != nil {
+		return nil, err
+	}
+
+	spent := make(map[string]bool)
+	for _, tx := range txs {
+		for _, in := range tx.Inputs {
+			spent[outpoint(in.ID, in.Out)] = true
+		}
+	}
+
+	return spent, nil
+}
+
+// removes the transactions the block confirms, and the ones that spend
+// an output the block spends, since they can never be mined now.
+// pending is the mempool as it was before the batch
+func (pool Mempool) update(b Batch, block *Block, pending []*Transaction) error {
+	spent := make(map[string]bool)
+	for _, tx := range block.Transactions {
+		for _, in := range tx.Inputs {
+			spent[outpoint(in.ID, in.Out)] = true
+		}
+	}
+
+Pending:
+	for _, ptx := range pending {
+		for _, tx := range block.Transactions {
+			if bytes.Equal(ptx.ID, tx.ID) {
+				if err := b.Delete(mempoolKey(ptx.ID)); err != nil {
+					return err
+				}
+				continue Pending
+			}
+		}
+
+		for _, in := range ptx.Inputs {
+			if spent[outpoint(in.ID, in.Out)] {
+				if err := b.Delete(mempoolKey(ptx.ID)); err != nil {
+					return err
+				}
+				continue Pending
+			}
+		}
+	}
+
+	return nil
+}
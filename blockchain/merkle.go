@@ -0,0 +1,141 @@
+package blockchain
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+)
+
+// a merkle tree hashes the transactions of a block in pairs,
+// then hashes those hashes in pairs, until one root hash is left.
+// a single transaction can then be proven to be in a block with
+// just the hashes along its path to the root
+
+type MerkleTree struct {
+	RootNode *MerkleNode
+}
+
+type MerkleNode struct {
+	Left  *MerkleNode
+	Right *MerkleNode
+	Data  []byte // the hash of this node
+}
+
+// one step of an inclusion proof: the hash next to ours,
+// and whether it sits on the left
+type MerkleStep struct {
+	Hash []byte
+	Left bool
+}
+
+type MerkleProof struct {
+	Steps []MerkleStep
+}
+
+// leaves hash their data, other nodes hash their two children joined together
+func NewMerkleNode(left, right *MerkleNode, data []byte) *MerkleNode {
+	node := MerkleNode{}
+
+	if left == nil && right == nil {
+		hash := sha256.Sum256(data)
+		node.Data = hash[:]
+	} else {
+		prevHashes := append(append([]byte{}, left.Data...), right.Data...)
+		hash := sha256.Sum256(prevHashes)
+		node.Data = hash[:]
+	}
+
+	node.Left = left
+	node.Right = right
+
+	return &node
+}
+
+func NewMerkleTree(data [][]byte) *MerkleTree {
+	var nodes []*MerkleNode
+
+	for _, dat := range data {
+		nodes = append(nodes, NewMerkleNode(nil, nil, dat))
+	}
+
+	if len(nodes) == 0 {
+		return &MerkleTree{NewMerkleNode(nil, nil, []byte{})}
+	}
+
+	for len(nodes) > 1 {
+		// a level with an odd number of nodes pairs its last node with itself
+		if len(nodes)%2 != 0 {
+			nodes = append(nodes, nodes[len(nodes)-1])
+		}
+
+		var level []*MerkleNode
+		for i := 0; i < len(nodes); i += 2 {
+			level = append(level, NewMerkleNode(nodes[i], nodes[i+1], nil))
+		}
+		nodes = level
+	}
+
+	return &MerkleTree{nodes[0]}
+}
+
+// builds the proof that data[index] is a leaf of the tree built from data
+func NewMerkleProof(data [][]byte, index int) (*MerkleProof, error) {
+	if index < 0 || index >= len(data) {
+		return nil, errors.New("leaf is not in the tree")
+	}
+
+	var level [][]byte
+	for _, dat := range data {
+		level = append(level, NewMerkleNode(nil, nil, dat).Data)
+	}
+
+	proof := MerkleProof{}
+
+	for len(level) > 1 {
+		if len(level)%2 != 0 {
+			level = append(level, level[len(level)-1])
+		}
+
+		// record our sibling, then move up a level
+		if index%2 == 0 {
+			proof.Steps = append(proof.Steps, MerkleStep{level[index+1], false})
+		} else {
+			proof.Steps = append(proof.Steps, MerkleStep{level[index-1], true})
+		}
+
+		var next [][]byte
+		for i := 0; i < len(level); i += 2 {
+			hash := sha256.Sum256(append(append([]byte{}, level[i]...), level[i+1]...))
+			next = append(next, hash[:])
+		}
+		level = next
+		index /= 2
+	}
+
+	return &proof, nil
+}
+
+// hashes data up the path given by the proof and checks it lands on root.
+// a nil proof proves nothing. leaves and inner nodes are hashed the same
+// way, so data has to be a transaction id: two child hashes joined
+// together would otherwise pass as a leaf one level up
+func (p *MerkleProof) Verify(root, data []byte) bool {
+	if p == nil || len(data) != sha256.Size {
+		return false
+	}
+
+	hash := NewMerkleNode(nil, nil, data).Data
+
+	for _, step := range p.Steps {
+		var joined []byte
+		if step.Left {
+			joined = append(append(joined, step.Hash...), hash...)
+		} else {
+			joined = append(append(joined, hash...), step.Hash...)
+		}
+		sum := sha256.Sum256(joined)
+		hash = sum[:]
+	}
+
+	return bytes.Equal(hash, root)
+}
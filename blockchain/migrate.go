@@ -0,0 +1,114 @@
+package blockchain
+
+import "errors"
+
+// rewrites a store made before the binary encoding: every block and utxo
+// entry still in gob is written again in the new encoding. the blocks
+// keep their version, hashes and ids, so nothing has to be mined again.
+// transactions waiting in the mempool were signed under the gob rules
+// and are dropped, they have to be sent again. the block indexes are
+// rebuilt too, older chains don't have them. returns how many
+// values were rewritten and how many transactions were dropped
+func (chain *BlockChain) Migrate() (int, int, error) {
+	db := chain.Database
+
+	var keys, values [][]byte
+	var dropped [][]byte
+
+	// walked back from the tip, older chains have no height index
+	iter := chain.Iterator()
+	for {
+		block, err := iter.Next()
+		if errors.Is(err, ErrNoMoreBlocks) {
+			break
+		}
+		if err != nil {
+			return 0, 0, err
+		}
+
+		encoded, err := db.Get(block.Hash)
+		if err != nil {
+			return 0, 0, err
+		}
+		if isCanonical(encoded) {
+			continue // already migrated
+		}
+
+		value, err := block.Serialize()
+		if err != nil {
+			return 0, 0, err
+		}
+		keys = append(keys, block.Hash)
+		values = append(values, value)
+	}
+
+	err := db.IteratePrefix(utxoPrefix, func(k, v []byte) error {
+		if isCanonical(v) {
+			return nil
+		}
+
+		outs, err := DeserializeOutputs(v)
+		if err != nil {
+			return err
+		}
+		value, err := outs.Serialize()
+		if err != nil {
+			return err
+		}
+
+		keys = append(keys, append([]byte{}, k...))
+		values = append(values, value)
+		return nil
+	})
+	if err != nil {
+		return 0, 0, err
+	}
+
+	err = db.IteratePrefix(mempoolPrefix, func(k, v []byte) error {
+		if !isCanonical(v) {
+			dropped = append(dropped, append([]byte{}, k...))
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, 0, err
+	}
+
+	// written in chunks, like the utxo reindex
+	for start := 0; start < len(keys); start += collectSize {
+		end := start + collectSize
+		if end > len(keys) {
+			end = len(keys)
+		}
+
+		err := db.Update(func(b Batch) error {
+			for i := start; i < end; i++ {
+				if err := b.Set(keys[i], values[i]); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return 0, 0, err
+		}
+	}
+
+	err = db.Update(func(b Batch) error {
+		for _, key := range dropped {
+			if err := b.Delete(key); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, 0, err
+	}
+
+	if err := chain.ReindexBlocks(); err != nil {
+		return 0, 0, err
+	}
+
+	return len(keys), len(dropped), nil
+}
@@ -2,11 +2,17 @@ package blockchain
 
 import (
 	"bytes"
+	"context"
 	"crypto/sha256"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"math"
 	"math/big"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
 // proof of algorithms / consensus algorithms
@@ -29,78 +35,319 @@ import (
 // set of requirements:
 // first few bytes must contain 0
 
-const diff = 18 // static difficulty
-// however, in a genuine blockchain, difficulty increments over time
+// difficulty is the number of leading zero bits a block hash needs.
+// every block carries the difficulty it was mined at in its Bits,
+// and every retargetInterval blocks it is recomputed from how long
+// those blocks actually took compared to targetBlockTime
+const (
+	initialDifficulty = 18 // difficulty of the genesis block
+	retargetInterval  = 10 // blocks between difficulty changes
+	targetBlockTime   = 10 // seconds we want between blocks
+	maxAdjustment     = 2  // most bits a retarget can move, i.e. a factor of 4
+	minDifficulty     = 1
+	maxDifficulty     = 255
+)
 
 type ProofOfWork struct {
 	Block  *Block   // a specific block
+	Bits   int      // the difficulty the block has to meet
 	Target *big.Int // a value that determines the
-	// validity of a block. based on the diff value
+	// validity of a block. based on the difficulty
+	Workers int // goroutines Run splits the nonces between
+}
+
+// a proof of work at the difficulty the block says it was mined at.
+// used for mining, use BlockChain.NewProof to check a block against the chain rules
+func NewProof(b *Block) (*ProofOfWork, error) {
+	return newProof(b, b.Bits)
 }
 
-func NewProof(b *Block) *ProofOfWork {
+// bits outside minDifficulty and maxDifficulty get an error wrapping
+// ErrInvalidBlock, the shift below only works for bits in that range
+func newProof(b *Block, bits int) (*ProofOfWork, error) {
+	if bits < minDifficulty || bits > maxDifficulty {
+		return nil, fmt.Errorf("%w %x: difficulty %d is outside %d to %d", ErrInvalidBlock, b.Hash, bits, minDifficulty, maxDifficulty)
+	}
+
 	// get a new BigInt
 	target := big.NewInt(1)
 	// shift number of bytes in target
-	// by uint(256-diff) (256 is the number of bytes in our hash)
+	// by uint(256-bits) (256 is the number of bits in our hash)
 	// lsh basically just does a left shift
-	target.Lsh(target, uint(256-diff))
+	target.Lsh(target, uint(256-bits))
 
 	// creates and returns a new proof of work
-	pow := &ProofOfWork{b, target}
-	return pow
+	pow := &ProofOfWork{b, bits, target, runtime.NumCPU()}
+	return pow, nil
+}
+
+// a proof of work at the difficulty the chain requires at the block's height
+func (chain *BlockChain) NewProof(b *Block) (*ProofOfWork, error) {
+	bits, err := chain.RequiredBits(b.Height, b.PrevHash)
+	if err != nil {
+		return nil, err
+	}
+
+	return newProof(b, bits)
+}
+
+// the difficulty a block at height, on top of prevHash, must be mined at
+func (chain *BlockChain) RequiredBits(height int, prevHash []byte) (int, error) {
+	if height == 0 {
+		return initialDifficulty, nil
+	}
+
+	prev, err := chain.getBlock(prevHash)
+	if err != nil {
+		return 0, err
+	}
+
+	// only retarget at the start of an interval
+	if height%retargetInterval != 0 {
+		return clampBits(prev.Bits), nil
+	}
+
+	// walk back to the first block of the interval that just ended
+	first := prev
+	for i := 1; i < retargetInterval; i++ {
+		first, err = chain.getBlock(first.PrevHash)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	expected := int64(retargetInterval-1) * targetBlockTime
+	actual := prev.Timestamp - first.Timestamp
+
+	// clamp the timespan so one odd interval can't swing the difficulty too far
+	minSpan := expected >> maxAdjustment
+	maxSpan := expected << maxAdjustment
+	if actual < minSpan {
+		actual = minSpan
+	}
+	if actual > maxSpan {
+		actual = maxSpan
+	}
+
+	// each bit doubles the work, so move by log2 of how far off we were
+	adjust := int(math.Round(math.Log2(float64(expected) / float64(actual))))
+
+	return clampBits(prev.Bits + adjust), nil
+}
+
+// keeps a difficulty between minDifficulty and maxDifficulty
+func clampBits(bits int) int {
+	if bits < minDifficulty {
+		bits = minDifficulty
+	}
+	if bits > maxDifficulty {
+		bits = maxDifficulty
+	}
+
+	return bits
 }
 
 // replaces the derive hash.
-// integrates the difficulty value into the hash.
+// joins every field of the block header, with the nonce we're trying
 func (pow *ProofOfWork) InitData(nonce int) []byte {
+	header := pow.Block.BlockHeader
+
 	data := bytes.Join(
 		[][]byte{
-			// uses prevHash and data again, + nonce and diff in bytes,
-			// to create a better hash
-			// joins the 4 values
-			pow.Block.PrevHash,
-			pow.Block.HashTransactions(),
-			ToHex(int64(nonce)), // nonce value in bytes
-			ToHex(int64(diff)),  // diff value in bytes
+			ToHex(int64(header.Version)),
+			header.PrevHash,
+			header.MerkleRoot, // commits to every transaction in the block
+			ToHex(header.Timestamp),
+			ToHex(int64(header.Bits)), // diff value in bytes
+			ToHex(int64(nonce)),       // nonce value in bytes
+			ToHex(int64(header.Height)),
 		},
 		[]byte{},
 	)
 	return data
 }
 
-func (pow *ProofOfWork) Run() (int, []byte) {
-	var intHash big.Int
-	var hash [32]byte
+// a nonce that solves the proof of work, and its hash
+type powSolution struct {
+	nonce int
+	hash  []byte
+}
 
-	nonce := 0 // defines a nonce
+// how RunContext mines
+type MiningOptions struct {
+	Workers          int                  // goroutines to mine on, 0 uses pow.Workers
+	Progress         func(MiningProgress) // called while mining, may be nil
+	ProgressInterval time.Duration        // time between progress calls, 0 means a second
+}
 
-	for nonce < math.MaxInt64 {
-		// essentially an infinite loop
-		data := pow.InitData(nonce) // concats our data
-		hash = sha256.Sum256(data)  // hashes our concatted data
+// a snapshot of how mining is going
+type MiningProgress struct {
+	Tried    int64  // nonces hashed so far
+	BestHash []byte // the lowest hash found so far
+	Elapsed  time.Duration
+}
 
-		fmt.Printf("\r%x", hash)
-		intHash.SetBytes((hash[:])) // sets intHash to the full slice of hashes
+// returned by RunContext when its context is cancelled or
+// hits its deadline before a nonce is found
+type MiningAbortedError struct {
+	Tried int64 // nonces hashed before giving up
+	Err   error // context.Canceled or context.DeadlineExceeded
+}
 
-		if intHash.Cmp(pow.Target) == -1 { // if intHash is less than Target
-			break // break as we've found a valid hash for the block
-		} else {
-			nonce++ // continue with a higher nonce until we find a good val
+func (e *MiningAbortedError) Error() string {
+	return fmt.Sprintf("mining aborted after %d hashes: %v", e.Tried, e.Err)
+}
+
+func (e *MiningAbortedError) Unwrap() error {
+	return e.Err
+}
+
+// mines until a solution is found. use RunContext to
+// stop it early or to hear how it is going
+func (pow *ProofOfWork) Run() (int, []byte, error) {
+	// returns our nonce value and slice of hash
+	return pow.RunContext(context.Background(), MiningOptions{})
+}
+
+// searches for a nonce on several goroutines at once, until one is
+// found or ctx is done. worker i tries nonces i, i+workers, i+2*workers...
+// and every worker stops as soon as one of them finds a solution.
+// opts.Progress is called from its own goroutine every interval, and
+// once more when the search ends
+func (pow *ProofOfWork) RunContext(parent context.Context, opts MiningOptions) (int, []byte, error) {
+	workers := opts.Workers
+	if workers < 1 {
+		workers = pow.Workers
+	}
+	if workers < 1 {
+		workers = 1
+	}
+
+	interval := opts.ProgressInterval
+	if interval <= 0 {
+		interval = time.Second
+	}
+
+	// cancelled when the parent is, or when a solution turns up
+	ctx, cancel := context.WithCancel(parent)
+	defer cancel()
+
+	found := make(chan powSolution, workers) // buffered so no worker blocks on send
+	var hashes atomic.Int64                  // total hashes tried
+	var wg sync.WaitGroup
+
+	// the lowest hash any worker has seen
+	var bestMu sync.Mutex
+	var best []byte
+
+	start := time.Now()
+
+	report := func() {
+		if opts.Progress == nil {
+			return
 		}
+		bestMu.Lock()
+		bestHash := append([]byte(nil), best...)
+		bestMu.Unlock()
+
+		opts.Progress(MiningProgress{hashes.Load(), bestHash, time.Since(start)})
 	}
 
-	fmt.Println()
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(first int) {
+			defer wg.Done()
+
+			var intHash big.Int
+			var localBest []byte
+			tried := int64(0)
+			defer func() { hashes.Add(tried % 1024) }() // whatever wasn't counted yet
+
+			for nonce := first; nonce <= math.MaxInt64-workers; nonce += workers {
+				select {
+				case <-ctx.Done():
+					return // cancelled, or another worker found it
+				default:
+				}
 
-	return nonce, hash[:] // returns our nonce value and slice of hash
+				data := pow.InitData(nonce) // concats our data
+				hash := sha256.Sum256(data) // hashes our concatted data
+
+				// counted in batches to keep the workers from fighting over the counter
+				tried++
+				if tried%1024 == 0 {
+					hashes.Add(1024)
+				}
+
+				if localBest == nil || bytes.Compare(hash[:], localBest) < 0 {
+					localBest = append([]byte(nil), hash[:]...)
+					bestMu.Lock()
+					if best == nil || bytes.Compare(localBest, best) < 0 {
+						best = localBest
+					}
+					bestMu.Unlock()
+				}
+
+				intHash.SetBytes(hash[:]) // sets intHash to the full slice of hashes
+
+				if intHash.Cmp(pow.Target) == -1 { // if intHash is less than Target
+					found <- powSolution{nonce, hash[:]}
+					return
+				}
+			}
+		}(w)
+	}
+
+	// if every worker stops without a solution, there is nothing to wait for
+	go func() {
+		wg.Wait()
+		close(found)
+	}()
+
+	reporterDone := make(chan struct{})
+	go func() {
+		defer close(reporterDone)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				report()
+			}
+		}
+	}()
+
+	solution, ok := <-found
+	cancel()
+	wg.Wait()
+	<-reporterDone
+	report()
+
+	if !ok {
+		if err := parent.Err(); err != nil {
+			return 0, nil, &MiningAbortedError{hashes.Load(), err}
+		}
+		return 0, nil, errors.New("no nonce solves the proof of work")
+	}
+
+	return solution.nonce, solution.hash, nil
 }
 
 // validates a block
 func (pow *ProofOfWork) Validate() bool {
 	var intHash big.Int
 
+	// the block has to claim the difficulty it is being checked at,
+	// the claimed bits are part of the hashed data
+	if pow.Block.Bits != pow.Bits {
+		return false
+	}
+
 	data := pow.InitData(pow.Block.Nonce)
-	// initializes the data by combining prev hash with nonce, curr data, and diff
+	// initializes the data by combining the header fields with the nonce
 
 	hash := sha256.Sum256(data)
 	intHash.SetBytes(hash[:])
@@ -112,14 +359,11 @@ func (pow *ProofOfWork) Validate() bool {
 }
 
 func ToHex(num int64) []byte {
-	buff := new(bytes.Buffer)
+	buff := make([]byte, 8)
 	// takes our number, and converts it into bytes
-	err := binary.Write(buff, binary.BigEndian, num)
+	binary.BigEndian.PutUint64(buff, uint64(num))
 	// BigEndian specifies the organization of our bytes
 
-	// if err has a value
-	Handle(err)
-
 	// return the bytes in buff
-	return buff.Bytes()
+	return buff
 }
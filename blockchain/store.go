@@ -0,0 +1,78 @@
+package blockchain
+
+import (
+	"errors"
+	"fmt"
+)
+
+// returned by Store.Get and Batch.Get when a key isn't there
+var ErrKeyNotFound = errors.New("key not found")
+
+// the key the hash of the newest block is stored under
+var tipKey = []byte("lh")
+
+// the key the chain's coinbase maturity is stored under
+var maturityKey = []byte("maturity")
+
+// set while every block of the chain is in the transaction index
+var txIndexKey = []byte("txindex")
+
+// where the chain keeps its blocks, tip and indexes. blocks are
+// stored under their hash, everything else under its own prefix.
+// BadgerStore keeps them on disk, MemoryStore keeps them in memory
+type Store interface {
+	GetBlock(hash []byte) (*Block, error) // ErrBlockNotFound if it isn't stored
+	PutBlock(block *Block) error
+	GetTip() ([]byte, error) // ErrChainNotFound if there is no tip yet
+	SetTip(hash []byte) error
+
+	Get(key []byte) ([]byte, error) // ErrKeyNotFound if it isn't stored
+	// runs fn with a batch whose writes are applied together, only if fn returns nil.
+	// fn should only use the batch, not the store
+	Update(fn func(Batch) error) error
+	// calls fn for every key starting with prefix, in key order
+	IteratePrefix(prefix []byte, fn func(key, value []byte) error) error
+
+	Close() error
+}
+
+// a group of writes applied together by Store.Update.
+// Get sees the writes made earlier in the same batch
+type Batch interface {
+	Get(key []byte) ([]byte, error)
+	Set(key, value []byte) error
+	Delete(key []byte) error
+	PutBlock(block *Block) error
+	SetTip(hash []byte) error
+}
+
+// shared by the stores: blocks are serialized under their hash
+func putBlock(b Batch, block *Block) error {
+	encoded, err := block.Serialize()
+	if err != nil {
+		return err
+	}
+
+	return b.Set(block.Hash, encoded)
+}
+
+func getBlock(get func([]byte) ([]byte, error), hash []byte) (*Block, error) {
+	encoded, err := get(hash)
+	if errors.Is(err, ErrKeyNotFound) {
+		return nil, fmt.Errorf("%w: %x", ErrBlockNotFound, hash)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return Deserialize(encoded)
+}
+
+func getTip(get func([]byte) ([]byte, error)) ([]byte, error) {
+	tip, err := get(tipKey)
+	if errors.Is(err, ErrKeyNotFound) {
+		return nil, ErrChainNotFound
+	}
+
+	return tip, err
+}
@@ -0,0 +1,58 @@
+package blockchain
+
+// the coins a miner may pay itself in a coinbase, besides the fees.
+// it starts at initialSubsidy and halves every halvingInterval blocks,
+// and no more is paid once MaxSupply coins have been made
+const (
+	initialSubsidy  = 100
+	halvingInterval = 1000
+	MaxSupply       = 190000
+)
+
+// the subsidy the halvings alone allow at height
+func halvedSubsidy(height int) int {
+	halvings := height / halvingInterval
+	if halvings >= 63 {
+		return 0 // shifted all the way down
+	}
+
+	return initialSubsidy >> halvings
+}
+
+// the subsidy for the block at height
+func Subsidy(height int) int {
+	if height < 0 {
+		return 0
+	}
+
+	subsidy := halvedSubsidy(height)
+	if left := MaxSupply - IssuedSupply(height); subsidy > left {
+		subsidy = left // the last coins before the cap
+	}
+
+	return subsidy
+}
+
+// the coins the schedule allows to be made by the blocks below height
+func IssuedSupply(height int) int {
+	issued := 0
+
+	// every era between halvings pays the same subsidy per block
+	for start := 0; start < height; start += halvingInterval {
+		subsidy := halvedSubsidy(start)
+		if subsidy == 0 {
+			break
+		}
+
+		blocks := halvingInterval
+		if height-start < blocks {
+			blocks = height - start
+		}
+		issued += subsidy * blocks
+	}
+
+	if issued > MaxSupply {
+		issued = MaxSupply
+	}
+	return issued
+}
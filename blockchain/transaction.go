@@ -1,67 +1,90 @@
 package blockchain
 
 import (
-	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
 	"crypto/sha256"
-	"encoding/gob"
 	"encoding/hex"
+	"errors"
 	"fmt"
-	"log"
+	"math"
+	"math/big"
+
+	"github.com/must108/blockchain/wallet"
 )
 
 type Transaction struct {
 	ID      []byte
 	Inputs  []TxInput  // slice of inputs
 	Outputs []TxOutput // slice of outputs
-}
 
-type TxOutput struct {
-	Value  int    // the value
-	PubKey string // to access a specific value
+	legacy bool // from a block before blockVersion 2, hashed with gob
 }
 
-type TxInput struct {
-	ID  []byte // references a transaction
-	Out int    // index of the output
-	Sig string // provides data, used in output's pubkey
+// the bytes the transaction is hashed over
+func (tx Transaction) hashData() ([]byte, error) {
+	if tx.legacy {
+		return legacyEncodeTransaction(tx)
+	}
+
+	return tx.Serialize()
 }
 
-// create a hash based on bytes
-func (tx *Transaction) SetID() {
-	var encoded bytes.Buffer
+// create a hash based on bytes. the id and the signatures are
+// left out, so signing the transaction doesn't change its id
+func (tx *Transaction) SetID() error {
 	var hash [32]byte
 
+	txCopy := *tx
+	txCopy.ID = nil
+	txCopy.Inputs = nil
+	for _, in := range tx.Inputs {
+		txCopy.Inputs = append(txCopy.Inputs, TxInput{in.ID, in.Out, nil, in.PubKey})
+	}
+
 	// encode the transaction
-	encode := gob.NewEncoder((&encoded))
-	err := encode.Encode(tx)
+	encoded, err := txCopy.hashData()
 
-	// handle any potential error
-	Handle(err)
+	// pass any potential error back up
+	if err != nil {
+		return err
+	}
 
-	hash = sha256.Sum256(encoded.Bytes())
+	hash = sha256.Sum256(encoded)
 	tx.ID = hash[:]
+	return nil
 }
 
-// takes in an address to, and string data
+// takes in an address to, string data, the height of the block
+// and the fees of the block's transactions
 // outputs a pointer to a transaction
-func CoinbaseTx(to, data string) *Transaction {
+func CoinbaseTx(to, data string, height, fees int) (*Transaction, error) {
 	if data == "" {
-		data = fmt.Sprintf("Coins to %s", to)
+		// random data, so two coinbases paying the same address get different ids
+		randData := make([]byte, 24)
+		if _, err := rand.Read(randData); err != nil {
+			return nil, err
+		}
+		data = fmt.Sprintf("%x", randData)
 	}
 
 	// txin takes a new TxInput with empty slice of bytes,
-	// output index of -1, and the data
-	txin := TxInput{[]byte{}, -1, data}
+	// output index of -1, no signature, and the data
+	txin := TxInput{[]byte{}, -1, nil, []byte(data)}
 
-	// txout takes in the reward (100 tokens)
-	// and pubkey string, which references to address!
-	txout := TxOutput{100, to}
+	// txout takes in the reward for the height plus the fees
+	// and is locked to the address
+	txout, err := NewTXOutput(Subsidy(height)+fees, to)
+	if err != nil {
+		return nil, err
+	}
 
 	// nil for id, and pass in TxInput and TxOutput slices
-	tx := Transaction{nil, []TxInput{txin}, []TxOutput{txout}}
-	tx.SetID()
+	tx := Transaction{Inputs: []TxInput{txin}, Outputs: []TxOutput{*txout}}
+	err = tx.SetID()
 
-	return &tx
+	return &tx, err
 }
 
 func (tx *Transaction) IsCoinbase() bool {
@@ -71,50 +94,248 @@ func (tx *Transaction) IsCoinbase() bool {
 	return len(tx.Inputs) == 1 && len(tx.Inputs[0].ID) == 0 && tx.Inputs[0].Out == -1
 }
 
-// if the unlock functions return true, it means
-// that the account owns the output/ref to output from input
-
-// check if the signature value is the same as the passed in data
-func (in *TxInput) CanUnlock(data string) bool {
-	return in.Sig == data
-}
-
-// check if the Pubkey is the same as the passed in data
-func (out *TxOutput) CanBeUnlocked(data string) bool {
-	return out.PubKey == data
-}
-
-func NewTransaction(from, to string, amount int, chain *BlockChain) *Transaction {
+// the fee is whatever the inputs hold beyond the outputs, the miner gets it
+func NewTransaction(w *wallet.Wallet, to string, amount, fee int, UTXO *UTXOSet) (*Transaction, error) {
 	var inputs []TxInput
 	var outputs []TxOutput
 
+	pubKeyHash := wallet.PublicKeyHash(w.PublicKey)
+	from := string(w.Address())
+
 	// get the accumulator and validOutputs from the method
-	acc, validOutputs := chain.FindSpendableOutputs(from, amount)
+	acc, validOutputs, err := UTXO.FindSpendableOutputs(pubKeyHash, amount+fee)
+	if err != nil {
+		return nil, err
+	}
 
-	if acc < amount {
-		log.Panic("Error: not enough funds")
+	if acc < amount+fee {
+		return nil, fmt.Errorf("%w: have %d, need %d", ErrInsufficientFunds, acc, amount+fee)
 	}
 
 	for txid, outs := range validOutputs { // iterate thru validOutputs
 		txID, err := hex.DecodeString(txid) // decode string from txid
-		Handle(err)
+		if err != nil {
+			return nil, err
+		}
 
 		for _, out := range outs { // iterate thru transaction outs
-			input := TxInput{txID, out, from} // create a new input for every unspent output
-			inputs = append(inputs, input)    // append every new input for the txn
+			input := TxInput{txID, out, nil, w.PublicKey} // create a new input for every unspent output
+			inputs = append(inputs, input)                // append every new input for the txn
 		}
 	}
 
-	outputs = append(outputs, TxOutput{amount, to}) // append a new output with new information
+	out, err := NewTXOutput(amount, to)
+	if err != nil {
+		return nil, err
+	}
+	outputs = append(outputs, *out) // append a new output with new information
 
-	if acc > amount {
-		outputs = append(outputs, TxOutput{acc - amount, from})
+	if acc > amount+fee {
+		change, err := NewTXOutput(acc-amount-fee, from)
+		if err != nil {
+			return nil, err
+		}
+		outputs = append(outputs, *change)
 	} // if there are left over tokens in the senders account
 
-	tx := Transaction{nil, inputs, outputs}
-	tx.SetID()
+	tx := Transaction{Inputs: inputs, Outputs: outputs}
+	if err := tx.SetID(); err != nil {
+		return nil, err
+	}
+
+	// sign every input with the sender's key
+	if err := UTXO.Blockchain.SignTransaction(&tx, w.PrivateKey); err != nil {
+		return nil, err
+	}
+
+	return &tx, nil
+}
+
+// what the inputs hold beyond the outputs. prevTXs holds the
+// transactions the inputs spend, and tx should have passed Verify with them.
+// negative values, or ones adding up past the largest int, are an error
+func (tx *Transaction) Fee(prevTXs map[string]Transaction) (int, error) {
+	if tx.IsCoinbase() {
+		return 0, nil
+	}
+
+	var inputs []TxOutput
+	for _, in := range tx.Inputs {
+		inputs = append(inputs, prevTXs[hex.EncodeToString(in.ID)].Outputs[in.Out])
+	}
+
+	in, err := sumOutputs(inputs)
+	if err != nil {
+		return 0, fmt.Errorf("%w %x: inputs %v", ErrInvalidTransaction, tx.ID, err)
+	}
+	out, err := sumOutputs(tx.Outputs)
+	if err != nil {
+		return 0, fmt.Errorf("%w %x: outputs %v", ErrInvalidTransaction, tx.ID, err)
+	}
+
+	return in - out, nil
+}
+
+// the value of outs added up, checked so it can't go negative or wrap around
+func sumOutputs(outs []TxOutput) (int, error) {
+	sum := 0
+	for _, out := range outs {
+		if out.Value < 0 {
+			return 0, fmt.Errorf("hold a negative value %d", out.Value)
+		}
+		if sum > math.MaxInt-out.Value {
+			return 0, errors.New("add up to more than the largest amount")
+		}
+		sum += out.Value
+	}
+
+	return sum, nil
+}
+
+// serializes the transaction into bytes
+func (tx Transaction) Serialize() ([]byte, error) {
+	e := newEncoder()
+	e.transaction(&tx)
+
+	return e.buf, nil
+}
+
+// reads a transaction written by Serialize, or by gob before that
+func DeserializeTransaction(data []byte) (Transaction, error) {
+	if !isCanonical(data) {
+		return legacyDeserializeTransaction(data)
+	}
+
+	d := newDecoder(data)
+	transaction := d.transaction()
+
+	return *transaction, d.finish()
+}
+
+// hashes a copy of the transaction without its id
+func (tx *Transaction) Hash() ([]byte, error) {
+	var hash [32]byte
+
+	txCopy := *tx
+	txCopy.ID = []byte{}
+
+	encoded, err := txCopy.hashData()
+	if err != nil {
+		return nil, err
+	}
+	hash = sha256.Sum256(encoded)
+
+	return hash[:], nil
+}
+
+// a copy of the transaction with the signatures and public keys
+// stripped out of the inputs. this is the data that gets signed
+func (tx *Transaction) TrimmedCopy() Transaction {
+	var inputs []TxInput
+	var outputs []TxOutput
+
+	for _, in := range tx.Inputs {
+		inputs = append(inputs, TxInput{in.ID, in.Out, nil, nil})
+	}
+
+	for _, out := range tx.Outputs {
+		outputs = append(outputs, TxOutput{out.Value, out.PubKeyHash})
+	}
+
+	txCopy := Transaction{ID: tx.ID, Inputs: inputs, Outputs: outputs, legacy: tx.legacy}
+
+	return txCopy
+}
+
+// signs each input of the transaction. prevTXs holds the transactions
+// that the inputs reference, keyed by hex encoded id
+func (tx *Transaction) Sign(privKey ecdsa.PrivateKey, prevTXs map[string]Transaction) error {
+	if tx.IsCoinbase() {
+		return nil // coinbase transactions have nothing to sign
+	}
+
+	for _, in := range tx.Inputs {
+		prevTX := prevTXs[hex.EncodeToString(in.ID)]
+		if prevTX.ID == nil {
+			return fmt.Errorf("%w: %x", ErrTransactionNotFound, in.ID)
+		}
+		if in.Out < 0 || in.Out >= len(prevTX.Outputs) {
+			return fmt.Errorf("%w: %x has no output %d", ErrInvalidTransaction, in.ID, in.Out)
+		}
+	}
+
+	txCopy := tx.TrimmedCopy()
+
+	for inId, in := range txCopy.Inputs {
+		prevTX := prevTXs[hex.EncodeToString(in.ID)]
+		// the input is signed together with the output it spends
+		txCopy.Inputs[inId].PubKey = prevTX.Outputs[in.Out].PubKeyHash
+		hash, err := txCopy.Hash()
+		if err != nil {
+			return err
+		}
+		txCopy.ID = hash
+		txCopy.Inputs[inId].PubKey = nil
+
+		signature, err := ecdsa.SignASN1(rand.Reader, &privKey, txCopy.ID)
+		if err != nil {
+			return err
+		}
+
+		tx.Inputs[inId].Signature = signature
+	}
+
+	return nil
+}
+
+// checks that every input is signed by the owner of the output it spends
+func (tx *Transaction) Verify(prevTXs map[string]Transaction) bool {
+	if tx.IsCoinbase() {
+		return true
+	}
+
+	if len(tx.Inputs) == 0 {
+		return false // without inputs there is nothing signed, coins would come from nowhere
+	}
+
+	for _, in := range tx.Inputs {
+		prevTX := prevTXs[hex.EncodeToString(in.ID)]
+		if prevTX.ID == nil || in.Out < 0 || in.Out >= len(prevTX.Outputs) {
+			return false // the input spends an output that doesn't exist
+		}
+	}
+
+	txCopy := tx.TrimmedCopy()
+	curve := elliptic.P256()
+
+	for inId, in := range tx.Inputs {
+		prevOut := prevTXs[hex.EncodeToString(in.ID)].Outputs[in.Out]
+
+		// the public key must belong to whoever the output is locked to
+		if len(in.PubKey) != 64 || !in.UsesKey(prevOut.PubKeyHash) {
+			return false
+		}
+
+		// rebuild the data that was signed
+		txCopy.Inputs[inId].PubKey = prevOut.PubKeyHash
+		hash, err := txCopy.Hash()
+		if err != nil {
+			return false
+		}
+		txCopy.ID = hash
+		txCopy.Inputs[inId].PubKey = nil
+
+		// split the public key back into X and Y
+		x := new(big.Int).SetBytes(in.PubKey[:32])
+		y := new(big.Int).SetBytes(in.PubKey[32:])
+		rawPubKey := ecdsa.PublicKey{Curve: curve, X: x, Y: y}
+
+		if !ecdsa.VerifyASN1(&rawPubKey, txCopy.ID, in.Signature) {
+			return false
+		}
+	}
 
-	return &tx
+	return true
 }
 
 // genesis block has our first transaction
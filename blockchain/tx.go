@@ -0,0 +1,80 @@
+package blockchain
+
+import (
+	"bytes"
+
+	"github.com/must108/blockchain/wallet"
+)
+
+type TxOutput struct {
+	Value      int    // the value
+	PubKeyHash []byte // hash of the public key that can spend this output
+}
+
+// the unspent outputs of one transaction, as stored in the utxo set.
+// Indexes holds the position of each output in its transaction
+type TxOutputs struct {
+	Outputs  []TxOutput
+	Indexes  []int
+	Coinbase bool // the outputs were made by a coinbase, so they have to mature
+	Height   int  // of the block the transaction is in
+}
+
+type TxInput struct {
+	ID        []byte // references a transaction
+	Out       int    // index of the output
+	Signature []byte // signature made with the spender's private key
+	PubKey    []byte // the spender's public key, used to check the signature
+}
+
+// creates an output locked to an address
+func NewTXOutput(value int, address string) (*TxOutput, error) {
+	txo := &TxOutput{value, nil}
+	err := txo.Lock([]byte(address))
+	if err != nil {
+		return nil, err
+	}
+
+	return txo, nil
+}
+
+// check if the input was made by the owner of pubKeyHash
+func (in *TxInput) UsesKey(pubKeyHash []byte) bool {
+	lockingHash := wallet.PublicKeyHash(in.PubKey)
+
+	return bytes.Equal(lockingHash, pubKeyHash)
+}
+
+// locks the output to the public key hash inside of an address
+func (out *TxOutput) Lock(address []byte) error {
+	pubKeyHash, err := wallet.AddressToPubKeyHash(string(address))
+	if err != nil {
+		return err
+	}
+
+	out.PubKeyHash = pubKeyHash
+	return nil
+}
+
+// check if the output is locked to pubKeyHash
+func (out *TxOutput) IsLockedWithKey(pubKeyHash []byte) bool {
+	return bytes.Equal(out.PubKeyHash, pubKeyHash)
+}
+
+func (outs TxOutputs) Serialize() ([]byte, error) {
+	e := newEncoder()
+	e.outputs(outs)
+
+	return e.buf, nil
+}
+
+func DeserializeOutputs(data []byte) (TxOutputs, error) {
+	if !isCanonical(data) {
+		return legacyDeserializeOutputs(data)
+	}
+
+	d := newDecoder(data)
+	outputs := d.outputs()
+
+	return outputs, d.finish()
+}
@@ -0,0 +1,355 @@
+package blockchain
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+)
+
+// the utxo set lives in the same store as the blocks,
+// with every key starting with this prefix
+var utxoPrefix = []byte("utxo-")
+
+// how many keys are written or deleted in one batch while reindexing
+const collectSize = 100000
+
+// an index of every unspent transaction output, so balances and
+// spendable outputs don't need a walk through the whole chain.
+// keys are utxoPrefix + txID, values are the serialized TxOutputs
+type UTXOSet struct {
+	Blockchain *BlockChain
+}
+
+// finds unspent outputs locked to pubKeyHash that add up to at least amount.
+// outputs already spent by a transaction in the mempool and
+// coinbase outputs that haven't matured are skipped
+func (u UTXOSet) FindSpendableOutputs(pubKeyHash []byte, amount int) (int, map[string][]int, error) {
+	unspentOuts := make(map[string][]int)
+	accumulated := 0
+	db := u.Blockchain.Database
+
+	pending, err := Mempool{u.Blockchain}.spentOutputs()
+	if err != nil {
+		return 0, nil, err
+	}
+
+	// the outputs are spent in the next block
+	height, err := u.Blockchain.GetBestHeight()
+	if err != nil {
+		return 0, nil, err
+	}
+
+	err = db.IteratePrefix(utxoPrefix, func(k, v []byte) error {
+		if accumulated >= amount {
+			return nil // already have enough
+		}
+
+		k = bytes.TrimPrefix(k, utxoPrefix)
+		txID := hex.EncodeToString(k)
+		outs, err := DeserializeOutputs(v)
+		if err != nil {
+			return err
+		}
+		if outs.Coinbase && !u.Blockchain.isMature(outs.Height, height+1) {
+			return nil // still maturing
+		}
+
+		for i, out := range outs.Outputs {
+			if pending[outpoint(k, outs.Indexes[i])] {
+				continue // waiting to be mined already
+			}
+			if out.IsLockedWithKey(pubKeyHash) && accumulated < amount {
+				accumulated += out.Value
+				unspentOuts[txID] = append(unspentOuts[txID], outs.Indexes[i])
+			}
+		}
+		return nil
+	})
+
+	return accumulated, unspentOuts, err
+}
+
+// the unspent outputs of the transaction with id txID,
+// ErrKeyNotFound if it has none
+func (u UTXOSet) outputs(txID []byte) (TxOutputs, error) {
+	key := append(append([]byte{}, utxoPrefix...), txID...)
+
+	v, err := u.Blockchain.Database.Get(key)
+	if err != nil {
+		return TxOutputs{}, err
+	}
+
+	return DeserializeOutputs(v)
+}
+
+// whether output out of the transaction with id txID is still unspent
+func (u UTXOSet) IsUnspent(txID []byte, out int) (bool, error) {
+	outs, err := u.outputs(txID)
+	if errors.Is(err, ErrKeyNotFound) {
+		return false, nil // spent, or never existed
+	}
+	if err != nil {
+		return false, err
+	}
+
+	for _, index := range outs.Indexes {
+		if index == out {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+// gets every unspent output locked to pubKeyHash
+func (u UTXOSet) FindUTXO(pubKeyHash []byte) ([]TxOutput, error) {
+	var UTXOs []TxOutput
+
+	db := u.Blockchain.Database
+
+	err := db.IteratePrefix(utxoPrefix, func(_, v []byte) error {
+		outs, err := DeserializeOutputs(v)
+		if err != nil {
+			return err
+		}
+
+		for _, out := range outs.Outputs {
+			if out.IsLockedWithKey(pubKeyHash) {
+				UTXOs = append(UTXOs, out)
+			}
+		}
+		return nil
+	})
+
+	return UTXOs, err
+}
+
+// the value of the unspent outputs locked to pubKeyHash, split into what
+// can be spent in the next block and coinbase outputs still maturing
+func (u UTXOSet) Balance(pubKeyHash []byte) (int, int, error) {
+	mature, immature := 0, 0
+
+	height, err := u.Blockchain.GetBestHeight()
+	if err != nil {
+		return 0, 0, err
+	}
+
+	err = u.Blockchain.Database.IteratePrefix(utxoPrefix, func(_, v []byte) error {
+		outs, err := DeserializeOutputs(v)
+		if err != nil {
+			return err
+		}
+
+		for _, out := range outs.Outputs {
+			if !out.IsLockedWithKey(pubKeyHash) {
+				continue
+			}
+			if outs.Coinbase && !u.Blockchain.isMature(outs.Height, height+1) {
+				immature += out.Value
+			} else {
+				mature += out.Value
+			}
+		}
+		return nil
+	})
+
+	return mature, immature, err
+}
+
+// the value of every unspent output, the coins in circulation
+func (u UTXOSet) TotalValue() (int, error) {
+	total := 0
+
+	err := u.Blockchain.Database.IteratePrefix(utxoPrefix, func(_, v []byte) error {
+		outs, err := DeserializeOutputs(v)
+		if err != nil {
+			return err
+		}
+
+		for _, out := range outs.Outputs {
+			total += out.Value
+		}
+		return nil
+	})
+
+	return total, err
+}
+
+// the number of transactions that still have unspent outputs
+func (u UTXOSet) CountTransactions() (int, error) {
+	db := u.Blockchain.Database
+	counter := 0
+
+	err := db.IteratePrefix(utxoPrefix, func(_, _ []byte) error {
+		counter++
+		return nil
+	})
+
+	return counter, err
+}
+
+// throws the utxo set away and rebuilds it from the blocks
+func (u UTXOSet) Reindex() error {
+	db := u.Blockchain.Database
+
+	if err := u.DeleteByPrefix(utxoPrefix); err != nil {
+		return err
+	}
+
+	UTXO, err := u.Blockchain.FindUTXO()
+	if err != nil {
+		return err
+	}
+
+	// write in batches so a big set doesn't overflow one batch
+	keys := make([][]byte, 0, collectSize)
+	values := make([][]byte, 0, collectSize)
+
+	flush := func() error {
+		err := db.Update(func(b Batch) error {
+			for i := range keys {
+				if err := b.Set(keys[i], values[i]); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		keys, values = keys[:0], values[:0]
+		return err
+	}
+
+	for txId, outs := range UTXO {
+		key, err := hex.DecodeString(txId)
+		if err != nil {
+			return err
+		}
+		key = append(append([]byte{}, utxoPrefix...), key...)
+
+		value, err := outs.Serialize()
+		if err != nil {
+			return err
+		}
+
+		keys = append(keys, key)
+		values = append(values, value)
+		if len(keys) == collectSize {
+			if err := flush(); err != nil {
+				return err
+			}
+		}
+	}
+
+	return flush()
+}
+
+// updates the utxo set with the transactions of a new block
+func (u *UTXOSet) Update(block *Block) error {
+	db := u.Blockchain.Database
+
+	return db.Update(func(b Batch) error {
+		return u.update(b, block)
+	})
+}
+
+// removes the outputs the block spends and adds the ones it creates.
+// runs inside the caller's batch, so a block and its
+// utxo changes are written together
+func (u *UTXOSet) update(b Batch, block *Block) error {
+	// in block order, so a transaction spending an output made
+	// earlier in the same block sees that output
+	for _, tx := range block.Transactions {
+		if tx.IsCoinbase() == false {
+			for _, in := range tx.Inputs {
+				inID := append(append([]byte{}, utxoPrefix...), in.ID...)
+				v, err := b.Get(inID)
+				if err != nil {
+					return err
+				}
+
+				outs, err := DeserializeOutputs(v)
+				if err != nil {
+					return err
+				}
+				updatedOuts := TxOutputs{Coinbase: outs.Coinbase, Height: outs.Height}
+
+				for i, out := range outs.Outputs {
+					if outs.Indexes[i] != in.Out { // keep everything but the spent output
+						updatedOuts.Outputs = append(updatedOuts.Outputs, out)
+						updatedOuts.Indexes = append(updatedOuts.Indexes, outs.Indexes[i])
+					}
+				}
+
+				if len(updatedOuts.Outputs) == 0 {
+					// every output of the transaction is spent
+					if err := b.Delete(inID); err != nil {
+						return err
+					}
+				} else {
+					value, err := updatedOuts.Serialize()
+					if err != nil {
+						return err
+					}
+					if err := b.Set(inID, value); err != nil {
+						return err
+					}
+				}
+			}
+		}
+
+		newOutputs := TxOutputs{Coinbase: tx.IsCoinbase(), Height: block.Height}
+		for outIdx, out := range tx.Outputs {
+			newOutputs.Outputs = append(newOutputs.Outputs, out)
+			newOutputs.Indexes = append(newOutputs.Indexes, outIdx)
+		}
+
+		txID := append(append([]byte{}, utxoPrefix...), tx.ID...)
+		value, err := newOutputs.Serialize()
+		if err != nil {
+			return err
+		}
+		if err := b.Set(txID, value); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// deletes every key starting with prefix
+func (u *UTXOSet) DeleteByPrefix(prefix []byte) error {
+	db := u.Blockchain.Database
+
+	deleteKeys := func(keysForDelete [][]byte) error {
+		return db.Update(func(b Batch) error {
+			for _, key := range keysForDelete {
+				if err := b.Delete(key); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+	}
+
+	// collect the keys first, deleting while iterating isn't safe in every store
+	var keys [][]byte
+	err := db.IteratePrefix(prefix, func(key, _ []byte) error {
+		keys = append(keys, key)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for len(keys) > 0 {
+		n := len(keys)
+		if n > collectSize {
+			n = collectSize
+		}
+		if err := deleteKeys(keys[:n]); err != nil {
+			return err
+		}
+		keys = keys[n:]
+	}
+
+	return nil
+}
@@ -0,0 +1,313 @@
+package blockchain
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"time"
+)
+
+// a block's timestamp can't be earlier than the median of the blocks
+// before it, or too far ahead of the clock
+const (
+	medianTimeBlocks   = 11
+	maxFutureBlockTime = 2 * 60 * 60 // seconds
+)
+
+// checks that block can go on top of the tip. every failure gets its own
+// error, wrapping ErrInvalidBlock or ErrInvalidTransaction
+func (chain *BlockChain) ValidateBlock(block *Block) error {
+	tip, err := chain.Database.GetTip()
+	if err != nil {
+		return err
+	}
+
+	// linked to the tip, one above it
+	if !bytes.Equal(block.PrevHash, tip) {
+		return fmt.Errorf("%w %x: prev hash %x is not the tip %x", ErrInvalidBlock, block.Hash, block.PrevHash, tip)
+	}
+	parent, err := chain.getBlock(tip)
+	if err != nil {
+		return err
+	}
+	if block.Height != parent.Height+1 {
+		return fmt.Errorf("%w %x: height %d, expected %d", ErrInvalidBlock, block.Hash, block.Height, parent.Height+1)
+	}
+	// old rules only carry on until the first block with new ones
+	if block.Version < parent.Version {
+		return fmt.Errorf("%w %x: version %d after version %d", ErrInvalidBlock, block.Hash, block.Version, parent.Version)
+	}
+
+	// mined at the difficulty the chain requires
+	bits, err := chain.RequiredBits(block.Height, tip)
+	if err != nil {
+		return err
+	}
+	if err := checkBlock(block, bits); err != nil {
+		return err
+	}
+
+	median, err := chain.medianTimePast(parent)
+	if err != nil {
+		return err
+	}
+	if block.Timestamp < median {
+		return fmt.Errorf("%w %x: timestamp %d is before the median %d of the last blocks", ErrInvalidBlock, block.Hash, block.Timestamp, median)
+	}
+	if block.Timestamp > time.Now().Unix()+maxFutureBlockTime {
+		return fmt.Errorf("%w %x: timestamp %d is too far in the future", ErrInvalidBlock, block.Hash, block.Timestamp)
+	}
+
+	_, err = chain.validateTransactions(block.Transactions, block.Height)
+	return err
+}
+
+// the checks that only need the block itself: the version, the proof of
+// work at bits, the hash, the merkle root and no repeated transactions
+func checkBlock(block *Block, bits int) error {
+	if block.Version != blockVersion && block.Version != legacyBlockVersion {
+		return fmt.Errorf("%w %x: unknown version %d", ErrInvalidBlock, block.Hash, block.Version)
+	}
+
+	// a tampered header may claim any difficulty
+	if block.Bits < minDifficulty || block.Bits > maxDifficulty {
+		return fmt.Errorf("%w %x: difficulty %d is outside %d to %d", ErrInvalidBlock, block.Hash, block.Bits, minDifficulty, maxDifficulty)
+	}
+	pow, err := newProof(block, bits)
+	if err != nil {
+		return err
+	}
+	if !pow.Validate() {
+		return fmt.Errorf("%w %x: proof of work doesn't meet %d bits", ErrInvalidBlock, block.Hash, bits)
+	}
+	hash := sha256.Sum256(pow.InitData(block.Nonce))
+	if !bytes.Equal(hash[:], block.Hash) {
+		return fmt.Errorf("%w %x: hash doesn't match the header", ErrInvalidBlock, block.Hash)
+	}
+
+	if len(block.Transactions) == 0 {
+		return fmt.Errorf("%w %x: no transactions", ErrInvalidBlock, block.Hash)
+	}
+	if !bytes.Equal(block.HashTransactions(), block.MerkleRoot) {
+		return fmt.Errorf("%w %x: merkle root doesn't match the transactions", ErrInvalidBlock, block.Hash)
+	}
+
+	seen := make(map[string]bool)
+	for _, tx := range block.Transactions {
+		id := fmt.Sprintf("%x", tx.ID)
+		if seen[id] {
+			return fmt.Errorf("%w %x: transaction %s is in it twice", ErrInvalidBlock, block.Hash, id)
+		}
+		seen[id] = true
+	}
+
+	return nil
+}
+
+// the median timestamp of parent and the blocks before it
+func (chain *BlockChain) medianTimePast(parent *Block) (int64, error) {
+	var timestamps []int64
+
+	block := parent
+	for {
+		timestamps = append(timestamps, block.Timestamp)
+		if len(timestamps) == medianTimeBlocks || len(block.PrevHash) == 0 {
+			break
+		}
+
+		var err error
+		block, err = chain.getBlock(block.PrevHash)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	sort.Slice(timestamps, func(i, j int) bool { return timestamps[i] < timestamps[j] })
+
+	return timestamps[len(timestamps)/2], nil
+}
+
+// checks the transactions of a block at height against the utxo set, and
+// returns the fees they pay. every id has to match its transaction and not
+// be one with unspent outputs. the first one has to be the only coinbase,
+// every output may only be spent once and only if it is unspent or made
+// earlier in the block, and the signatures, fees, maturity and reward must hold
+func (chain *BlockChain) validateTransactions(transactions []*Transaction, height int) (int, error) {
+	if len(transactions) == 0 || !transactions[0].IsCoinbase() {
+		return 0, fmt.Errorf("%w: the first transaction must be a coinbase", ErrInvalidBlock)
+	}
+
+	utxo := UTXOSet{chain}
+	spent := make(map[string]bool)
+	fees := 0
+
+	for i, tx := range transactions {
+		// inputs and the indexes find a transaction by its id, so it has to be the real one
+		if err := checkID(tx); err != nil {
+			return 0, err
+		}
+		// the same id again would write over the outputs still unspent under it.
+		// old chains may hold such repeats, they keep the old rules
+		if !tx.legacy {
+			if _, err := utxo.outputs(tx.ID); err == nil {
+				return 0, fmt.Errorf("%w %x: a transaction with this id still has unspent outputs", ErrInvalidTransaction, tx.ID)
+			} else if !errors.Is(err, ErrKeyNotFound) {
+				return 0, err
+			}
+		}
+		// a negative output would let the others pay out more than the inputs hold
+		if err := checkOutputs(tx); err != nil {
+			return 0, err
+		}
+		if i == 0 {
+			continue // the coinbase spends nothing
+		}
+		if tx.IsCoinbase() {
+			return 0, fmt.Errorf("%w: transaction %d is a second coinbase", ErrInvalidBlock, i)
+		}
+
+	Inputs:
+		for _, in := range tx.Inputs {
+			point := outpoint(in.ID, in.Out)
+			if spent[point] {
+				return 0, fmt.Errorf("%w: %s is spent twice in the block", ErrInvalidBlock, point)
+			}
+			spent[point] = true
+
+			// made earlier in the block, Verify checks the output is there
+			for _, ptx := range transactions[:i] {
+				if bytes.Equal(ptx.ID, in.ID) {
+					continue Inputs
+				}
+			}
+
+			unspent, err := utxo.IsUnspent(in.ID, in.Out)
+			if err != nil {
+				return 0, err
+			}
+			if !unspent {
+				return 0, fmt.Errorf("%w %x: %s is spent or not in the chain", ErrInvalidTransaction, tx.ID, point)
+			}
+		}
+
+		// signatures, and inputs worth at least the outputs
+		if err := chain.verifyTransaction(tx, transactions[:i]); err != nil {
+			return 0, err
+		}
+		fee, err := chain.transactionFee(tx, transactions[:i])
+		if err != nil {
+			return 0, err
+		}
+		if fees > math.MaxInt-fee {
+			return 0, fmt.Errorf("%w: the fees add up to more than the largest amount", ErrInvalidBlock)
+		}
+		fees += fee
+	}
+
+	if err := chain.checkMaturity(transactions, height); err != nil {
+		return 0, err
+	}
+	if err := checkCoinbase(transactions, height, fees); err != nil {
+		return 0, err
+	}
+
+	return fees, nil
+}
+
+// the id of tx has to be the hash of its contents,
+// or it could pass itself off as another transaction
+func checkID(tx *Transaction) error {
+	txCopy := *tx
+	if err := txCopy.SetID(); err != nil {
+		return err
+	}
+	if !bytes.Equal(txCopy.ID, tx.ID) {
+		return fmt.Errorf("%w %x: id doesn't match its contents", ErrInvalidTransaction, tx.ID)
+	}
+
+	return nil
+}
+
+// every output of tx has to pay something, or nothing
+func checkOutputs(tx *Transaction) error {
+	for i, out := range tx.Outputs {
+		if out.Value < 0 {
+			return fmt.Errorf("%w %x: output %d has a negative value %d", ErrInvalidTransaction, tx.ID, i, out.Value)
+		}
+	}
+
+	return nil
+}
+
+// whether a coinbase made at height can be spent in a block at spendHeight
+func (chain *BlockChain) isMature(height, spendHeight int) bool {
+	return spendHeight-height >= chain.CoinbaseMaturity
+}
+
+// checks that transactions going into a block at height only
+// spend coinbase outputs that have matured
+func (chain *BlockChain) checkMaturity(transactions []*Transaction, height int) error {
+	utxo := UTXOSet{chain}
+
+	for i, tx := range transactions {
+		if tx.IsCoinbase() {
+			continue
+		}
+
+	Inputs:
+		for _, in := range tx.Inputs {
+			// a coinbase earlier in the same block is made at this height
+			for _, ptx := range transactions[:i] {
+				if bytes.Equal(ptx.ID, in.ID) {
+					if ptx.IsCoinbase() && !chain.isMature(height, height) {
+						return fmt.Errorf("%w %x: spends an immature coinbase", ErrInvalidTransaction, tx.ID)
+					}
+					continue Inputs
+				}
+			}
+
+			outs, err := utxo.outputs(in.ID)
+			if errors.Is(err, ErrKeyNotFound) {
+				continue // not an unspent output, nothing to mature
+			}
+			if err != nil {
+				return err
+			}
+			if outs.Coinbase && !chain.isMature(outs.Height, height) {
+				return fmt.Errorf("%w %x: spends a coinbase from height %d, not spendable until height %d",
+					ErrInvalidTransaction, tx.ID, outs.Height, outs.Height+chain.CoinbaseMaturity)
+			}
+		}
+	}
+
+	return nil
+}
+
+// a block at height may pay its miner the subsidy and the fees, nothing more
+func checkCoinbase(transactions []*Transaction, height, fees int) error {
+	reward := 0
+	for _, tx := range transactions {
+		if tx.IsCoinbase() {
+			value, err := sumOutputs(tx.Outputs)
+			if err != nil {
+				return fmt.Errorf("%w: coinbase outputs %v", ErrInvalidBlock, err)
+			}
+			if reward > math.MaxInt-value {
+				return fmt.Errorf("%w: coinbases pay more than the largest amount", ErrInvalidBlock)
+			}
+			reward += value
+		}
+	}
+
+	if fees < 0 || fees > math.MaxInt-Subsidy(height) {
+		return fmt.Errorf("%w: fees of %d can't be paid out", ErrInvalidBlock, fees)
+	}
+	if allowed := Subsidy(height) + fees; reward > allowed {
+		return fmt.Errorf("%w: coinbase pays %d, only %d allowed at height %d", ErrInvalidBlock, reward, allowed, height)
+	}
+
+	return nil
+}
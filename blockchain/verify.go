@@ -0,0 +1,202 @@
+package blockchain
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"reflect"
+)
+
+// how much VerifyChain checks, each level does everything the ones below do
+const (
+	VerifyHeaders      = 1 // links, heights, proof of work, hashes and merkle roots
+	VerifyTransactions = 2 // ids, signatures, spends, fees and rewards, by replaying the chain
+	VerifyUTXO         = 3 // the stored utxo set matches the replayed one
+)
+
+var errUTXOMismatch = errors.New("the utxo set doesn't match the blocks, run reindexutxo")
+
+// the first problem VerifyChain found
+type VerifyError struct {
+	Height int
+	Hash   []byte
+	Err    error
+}
+
+func (e *VerifyError) Error() string {
+	return fmt.Sprintf("block %d (%x): %v", e.Height, e.Hash, e.Err)
+}
+
+func (e *VerifyError) Unwrap() error {
+	return e.Err
+}
+
+// walks every block from genesis to the tip and checks it at the given
+// level. returns the number of blocks checked, and a *VerifyError
+// for the first bad block
+func (chain *BlockChain) VerifyChain(level int) (int, error) {
+	if level < VerifyHeaders || level > VerifyUTXO {
+		return 0, fmt.Errorf("unknown verify level %d", level)
+	}
+
+	best, err := chain.GetBestHeight()
+	if err != nil {
+		return 0, err
+	}
+
+	// the thorough levels add every block to a copy of the chain kept in
+	// memory, which runs them through ValidateBlock against the utxo set
+	// as it was at their height
+	var replay *BlockChain
+	if level >= VerifyTransactions {
+		replay = &BlockChain{Database: NewMemoryStore(), CoinbaseMaturity: chain.CoinbaseMaturity}
+		defer replay.Database.Close()
+	}
+
+	var prev *Block
+	for height := 0; height <= best; height++ {
+		block, err := chain.GetBlockByHeight(height)
+		if err != nil {
+			return height, &VerifyError{height, nil, err}
+		}
+
+		if err := chain.verifyHeader(block, prev, height); err != nil {
+			return height, &VerifyError{height, block.Hash, err}
+		}
+
+		if replay != nil {
+			if err := replay.replayBlock(block); err != nil {
+				return height, &VerifyError{height, block.Hash, err}
+			}
+		}
+
+		prev = block
+	}
+
+	if !bytes.Equal(prev.Hash, chain.LastHash) {
+		return best + 1, &VerifyError{best, prev.Hash, fmt.Errorf("%w: the tip is %x", ErrInvalidBlock, chain.LastHash)}
+	}
+
+	if level >= VerifyUTXO {
+		if err := chain.compareUTXO(replay); err != nil {
+			return best + 1, &VerifyError{best, prev.Hash, err}
+		}
+	}
+
+	return best + 1, nil
+}
+
+// the checks that only need the headers of block and the one before it
+func (chain *BlockChain) verifyHeader(block, prev *Block, height int) error {
+	if block.Height != height {
+		return fmt.Errorf("%w: stored at height %d but says %d", ErrInvalidBlock, height, block.Height)
+	}
+
+	if prev == nil {
+		if len(block.PrevHash) != 0 {
+			return fmt.Errorf("%w: the genesis block has a prev hash", ErrInvalidBlock)
+		}
+	} else if !bytes.Equal(block.PrevHash, prev.Hash) {
+		return fmt.Errorf("%w: prev hash %x doesn't match block %d %x", ErrInvalidBlock, block.PrevHash, prev.Height, prev.Hash)
+	}
+
+	bits, err := chain.RequiredBits(block.Height, block.PrevHash)
+	if err != nil {
+		return err
+	}
+	if err := checkBlock(block, bits); err != nil {
+		return err
+	}
+
+	if prev != nil {
+		median, err := chain.medianTimePast(prev)
+		if err != nil {
+			return err
+		}
+		if block.Timestamp < median {
+			return fmt.Errorf("%w: timestamp %d is before the median %d of the last blocks", ErrInvalidBlock, block.Timestamp, median)
+		}
+	}
+
+	return nil
+}
+
+// checks the transaction ids of block and adds it to chain, the replayed copy
+func (chain *BlockChain) replayBlock(block *Block) error {
+	for _, tx := range block.Transactions {
+		if err := checkID(tx); err != nil {
+			return err
+		}
+	}
+
+	if len(block.PrevHash) != 0 {
+		return chain.AcceptBlock(block)
+	}
+
+	// the genesis block has no tip to go on, it only gets written
+	if !block.Transactions[0].IsCoinbase() || len(block.Transactions) != 1 {
+		return fmt.Errorf("%w: the genesis block must only hold a coinbase", ErrInvalidBlock)
+	}
+	if err := checkOutputs(block.Transactions[0]); err != nil {
+		return err
+	}
+	if err := checkCoinbase(block.Transactions, 0, 0); err != nil {
+		return err
+	}
+
+	err := chain.Database.Update(func(b Batch) error {
+		if err := b.PutBlock(block); err != nil {
+			return err
+		}
+		if err := chain.indexBlock(b, block); err != nil {
+			return err
+		}
+		utxo := UTXOSet{chain}
+		if err := utxo.update(b, block); err != nil {
+			return err
+		}
+		return b.SetTip(block.Hash)
+	})
+	if err != nil {
+		return err
+	}
+	chain.LastHash = block.Hash
+
+	return nil
+}
+
+// checks the stored utxo set holds exactly what the replayed one does
+func (chain *BlockChain) compareUTXO(replay *BlockChain) error {
+	expected := make(map[string]TxOutputs)
+	err := replay.Database.IteratePrefix(utxoPrefix, func(k, v []byte) error {
+		outs, err := DeserializeOutputs(v)
+		expected[string(k)] = outs
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	// compared decoded, the same outputs don't always encode to the same bytes
+	err = chain.Database.IteratePrefix(utxoPrefix, func(k, v []byte) error {
+		outs, err := DeserializeOutputs(v)
+		if err != nil {
+			return err
+		}
+		want, ok := expected[string(k)]
+		if !ok || !reflect.DeepEqual(want, outs) {
+			return fmt.Errorf("%w: entry %x", errUTXOMismatch, bytes.TrimPrefix(k, utxoPrefix))
+		}
+		delete(expected, string(k))
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for k := range expected {
+		return fmt.Errorf("%w: missing entry %x", errUTXOMismatch, bytes.TrimPrefix([]byte(k), utxoPrefix))
+	}
+
+	return nil
+}
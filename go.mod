@@ -1,10 +1,10 @@
-module github.com/must108/blockchain/blockchain/m/v2
+module github.com/must108/blockchain
 
 go 1.23.0
 
 require (
 	github.com/dgraph-io/badger v1.6.2
-	github.com/must108/blockchain v0.0.0-20240804185110-fb140a6ed3a6
+	golang.org/x/crypto v0.26.0
 )
 
 require (
@@ -1,136 +1,758 @@
 package main
 
 import (
+	"context"
+	"encoding/hex"
+	"errors"
 	"flag"
 	"fmt"
-	"log"
 	"os"
-	"runtime"
+	"os/signal"
 	"strconv"
+	"time"
 
 	"github.com/must108/blockchain/blockchain"
+	"github.com/must108/blockchain/wallet"
 )
 
-type CommandLine struct{}
+type CommandLine struct {
+	config blockchain.Config // which chain the commands run against
+}
+
+// returned after the usage has been printed
+var errUsage = errors.New("usage")
+
+// exit codes, so scripts can tell failures apart
+const (
+	exitFailure           = 1 // anything not listed below
+	exitUsage             = 2
+	exitChainNotFound     = 3
+	exitChainExists       = 4
+	exitInsufficientFunds = 5
+	exitNotFound          = 6 // a block or transaction that isn't there
+	exitInvalid           = 7 // a bad address, transaction or block
+	exitAborted           = 130
+)
+
+func exitCode(err error) int {
+	var aborted *blockchain.MiningAbortedError
+	var corrupt *blockchain.VerifyError
+
+	switch {
+	case errors.Is(err, errUsage):
+		return exitUsage
+	case errors.Is(err, blockchain.ErrChainNotFound):
+		return exitChainNotFound
+	case errors.Is(err, blockchain.ErrChainExists):
+		return exitChainExists
+	case errors.Is(err, blockchain.ErrInsufficientFunds):
+		return exitInsufficientFunds
+	case errors.Is(err, blockchain.ErrBlockNotFound), errors.Is(err, blockchain.ErrTransactionNotFound):
+		return exitNotFound
+	case errors.Is(err, wallet.ErrInvalidAddress), errors.Is(err, blockchain.ErrInvalidTransaction),
+		errors.Is(err, blockchain.ErrMempoolConflict), errors.Is(err, blockchain.ErrInvalidBlock):
+		return exitInvalid
+	case errors.As(err, &corrupt):
+		return exitInvalid
+	case errors.As(err, &aborted):
+		return exitAborted
+	}
+	return exitFailure
+}
 
 func (cli *CommandLine) printUsage() {
 	// prints how you can use this tool
-	fmt.Println("Usage:")
+	fmt.Println("Usage: [-datadir DIR] [-network NAME] [-txindex] COMMAND")
+	fmt.Printf("-datadir, -network and -txindex default to $%s, $%s and $%s\n", blockchain.DataDirEnv, blockchain.NetworkEnv, blockchain.TxIndexEnv)
 	fmt.Println("getbalance -address ADDRESS - get the balance for an address")
-	fmt.Println("createblockchain -address ADDRESS - creates a blockchain and sends genesis reward to address")
-	fmt.Println("printchain - Prints the blocks in the chain")
-	fmt.Println("send -from FROM -to TO -amount AMOUNT - Send amount of coins")
+	fmt.Println("history -address ADDRESS [-page N] [-pagesize N] - Lists the transactions of an address, newest first")
+	fmt.Println("createblockchain -address ADDRESS [-maturity BLOCKS] - creates a blockchain and sends genesis reward to address")
+	fmt.Println("printchain [-from HEIGHT] [-to HEIGHT] - Prints the blocks in the chain, oldest first if a height is given")
+	fmt.Println("printblock -height HEIGHT | -hash HASH - Prints one block")
+	fmt.Println("gettransaction -id ID - Prints a transaction and the block it is in")
+	fmt.Println("send -from FROM -to TO -amount AMOUNT [-fee FEE] [-mine] - Adds a transaction to the mempool, -mine mines it right away")
+	fmt.Println("mine -address ADDRESS [-maxsize BYTES] - Mines a block from the mempool, rewarding address")
+	fmt.Println("mempool - Lists the transactions waiting to be mined")
+	fmt.Println("supply - Prints the coins in circulation and the current block reward")
+	fmt.Println("createwallet - Creates a new wallet")
+	fmt.Println("reindexutxo - Rebuilds the UTXO set and the block indexes")
+	fmt.Println("migrate - Rewrites a chain made with the old gob encoding in the new one")
+	fmt.Println("verifychain [-level 1|2|3] - Checks every block: 1 headers, 2 transactions, 3 the UTXO set too")
+	fmt.Println("listaddresses - Lists the addresses in our wallet file")
+	fmt.Println("exportaddress -address ADDRESS - Prints an address and its public key to share")
 
 }
 
-func (cli *CommandLine) validateArgs() {
-	// if the terminal args is less than 2
-	if len(os.Args) < 2 {
+func (cli *CommandLine) validateArgs(args []string) error {
+	// if there is no command after the global flags
+	if len(args) < 1 {
 		cli.printUsage() // prints the instructions
-		runtime.Goexit() // exits the application,
-		// shuts down the go routine
+		return errUsage
 	}
+	return nil
 }
 
-// to print a blockchain... obviously
-func (cli *CommandLine) printChain() {
-	chain := blockchain.ContinueBlockChain("")
+func validateAddress(address string) error {
+	if !wallet.ValidateAddress(address) {
+		return fmt.Errorf("%w: %s", wallet.ErrInvalidAddress, address)
+	}
+	return nil
+}
+
+// to print a blockchain... obviously. newest first, or oldest first
+// between two heights when from or to are given (-1 if not)
+func (cli *CommandLine) printChain(from, to int) error {
+	chain, err := blockchain.ContinueBlockChain(cli.config, "")
+	if err != nil {
+		return err
+	}
 	defer chain.Database.Close()
-	iter := chain.Iterator()
+
+	// anything with a Next method walks the chain
+	var iter interface {
+		Next() (*blockchain.Block, error)
+	}
+
+	if from < 0 && to < 0 {
+		iter = chain.Iterator()
+	} else {
+		if from < 0 {
+			from = 0 // from the genesis block
+		}
+		if to < 0 {
+			if to, err = chain.GetBestHeight(); err != nil { // up to the tip
+				return err
+			}
+		}
+		if iter, err = chain.RangeIterator(from, to); err != nil {
+			return err
+		}
+	}
 
 	for {
-		block := iter.Next() // goes to the next block
-
-		// prints the prevHash, curr Block data, and curr Block hash.
-		fmt.Printf("Prev. hash: %x\n", block.PrevHash)
-		fmt.Printf("Hash: %x\n", block.Hash)
-		// gets the proof of work of the block
-		pow := blockchain.NewProof(block)
-		// prints the PoW once it is validated.
-		fmt.Printf("PoW: %s\n", strconv.FormatBool(pow.Validate()))
-		fmt.Println()
+		block, err := iter.Next() // goes to the next block
+		if errors.Is(err, blockchain.ErrNoMoreBlocks) {
+			break // to break out of the loop
+		}
+		if err != nil {
+			return err
+		}
+
+		if err := cli.printBlockDetails(chain, block); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// prints the block header, the curr Block hash and whether its PoW holds up
+func (cli *CommandLine) printBlockDetails(chain *blockchain.BlockChain, block *blockchain.Block) error {
+	// prints the block header and the curr Block hash.
+	fmt.Printf("Height: %d\n", block.Height)
+	fmt.Printf("Version: %d\n", block.Version)
+	fmt.Printf("Timestamp: %s\n", time.Unix(block.Timestamp, 0).Format(time.RFC3339))
+	fmt.Printf("Prev. hash: %x\n", block.PrevHash)
+	fmt.Printf("Merkle root: %x\n", block.MerkleRoot)
+	fmt.Printf("Bits: %d\n", block.Bits)
+	fmt.Printf("Nonce: %d\n", block.Nonce)
+	fmt.Printf("Hash: %x\n", block.Hash)
+	fmt.Printf("Transactions: %d\n", len(block.Transactions))
+	for _, tx := range block.Transactions {
+		fmt.Printf("  %x\n", tx.ID) // ids to look up with gettransaction
+	}
+	// gets the proof of work the chain requires of the block
+	pow, err := chain.NewProof(block)
+	if err != nil {
+		return err
+	}
+	// prints the PoW once it is validated.
+	fmt.Printf("PoW: %s\n", strconv.FormatBool(pow.Validate()))
+	fmt.Println()
+
+	return nil
+}
+
+func (cli *CommandLine) printBlock(height int, hash string) error {
+	chain, err := blockchain.ContinueBlockChain(cli.config, "")
+	if err != nil {
+		return err
+	}
+	defer chain.Database.Close()
+
+	var block *blockchain.Block
+	if hash != "" {
+		blockHash, err := hex.DecodeString(hash)
+		if err != nil {
+			return err
+		}
+		block, err = chain.GetBlockByHash(blockHash)
+		if err != nil {
+			return err
+		}
+	} else {
+		block, err = chain.GetBlockByHeight(height)
+		if err != nil {
+			return err
+		}
+	}
+
+	return cli.printBlockDetails(chain, block)
+}
+
+func (cli *CommandLine) getTransaction(id string) error {
+	txID, err := hex.DecodeString(id)
+	if err != nil {
+		return err
+	}
+
+	chain, err := blockchain.ContinueBlockChain(cli.config, "")
+	if err != nil {
+		return err
+	}
+	defer chain.Database.Close()
+
+	block, pos, err := chain.LocateTransaction(txID)
+	if err != nil {
+		return err
+	}
+	tx := block.Transactions[pos]
+
+	bestHeight, err := chain.GetBestHeight()
+	if err != nil {
+		return err
+	}
 
-		// to break out of the loop
-		if len(block.PrevHash) == 0 {
-			break
+	fmt.Printf("Transaction: %x\n", tx.ID)
+	fmt.Printf("Block: %x\n", block.Hash)
+	fmt.Printf("Height: %d\n", block.Height)
+	fmt.Printf("Position: %d\n", pos)
+	// the block itself counts as the first confirmation
+	fmt.Printf("Confirmations: %d\n", bestHeight-block.Height+1)
+
+	fee, err := chain.TransactionFee(tx)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Fee: %d\n", fee)
+
+	fmt.Println("Inputs:")
+	for i, in := range tx.Inputs {
+		if tx.IsCoinbase() {
+			fmt.Printf("  %d: coinbase %q\n", i, in.PubKey)
+			continue
 		}
+		from := wallet.PubKeyHashToAddress(wallet.PublicKeyHash(in.PubKey))
+		fmt.Printf("  %d: %x:%d from %s\n", i, in.ID, in.Out, from)
 	}
+
+	fmt.Println("Outputs:")
+	for i, out := range tx.Outputs {
+		fmt.Printf("  %d: %d to %s\n", i, out.Value, wallet.PubKeyHashToAddress(out.PubKeyHash))
+	}
+
+	return nil
 }
 
-func (cli *CommandLine) createBlockChain(address string) {
-	chain := blockchain.InitBlockChain(address) // init block chain
+func (cli *CommandLine) createBlockChain(address string) error {
+	if err := validateAddress(address); err != nil {
+		return err
+	}
+	chain, err := blockchain.InitBlockChain(cli.config, address) // init block chain
+	if err != nil {
+		return err
+	}
 	chain.Database.Close()
+	fmt.Println("Genesis created")
+	fmt.Printf("Genesis block: %x\n", chain.LastHash)
 	fmt.Println("Finished!")
+	return nil
 }
 
-func (cli *CommandLine) getBalance(address string) {
-	chain := blockchain.ContinueBlockChain(address) // open the blockchain
-	defer chain.Database.Close()                    // defer close of db
+func (cli *CommandLine) getBalance(address string) error {
+	pubKeyHash, err := wallet.AddressToPubKeyHash(address) // the hash the outputs are locked to
+	if err != nil {
+		return err
+	}
+	chain, err := blockchain.ContinueBlockChain(cli.config, address) // open the blockchain
+	if err != nil {
+		return err
+	}
+	defer chain.Database.Close() // defer close of db
 
-	balance := 0                     // create balance
-	UTXOs := chain.FindUTXO(address) // get unspent txn outputs
+	UTXOSet := blockchain.UTXOSet{Blockchain: chain} // balances come from the utxo index
 
-	for _, out := range UTXOs {
-		balance += out.Value // iterate thru address, and get output values
+	// coinbase outputs can't be spent until they are buried deep enough
+	mature, immature, err := UTXOSet.Balance(pubKeyHash)
+	if err != nil {
+		return err
 	}
+	balance := mature + immature
 
 	fmt.Printf("Balance of %s: %d\n", address, balance) // print the balance, with address
+	fmt.Printf("Mature: %d\n", mature)
+	fmt.Printf("Immature: %d\n", immature)
+	return nil
+}
+
+func (cli *CommandLine) history(address string, page, pageSize int) error {
+	pubKeyHash, err := wallet.AddressToPubKeyHash(address)
+	if err != nil {
+		return err
+	}
+	chain, err := blockchain.ContinueBlockChain(cli.config, address)
+	if err != nil {
+		return err
+	}
+	defer chain.Database.Close()
+
+	// pages start at 1
+	entries, err := chain.History(pubKeyHash, (page-1)*pageSize, pageSize)
+	if err != nil {
+		return err
+	}
+
+	if len(entries) == 0 {
+		fmt.Println("No transactions")
+		return nil
+	}
+
+	for _, entry := range entries {
+		direction := "received"
+		if entry.Sent > 0 {
+			direction = "sent"
+			if len(entry.Counterparty) == 0 {
+				direction = "self" // every output came back to the address
+			}
+		}
+
+		fmt.Printf("Transaction: %x\n", entry.Transaction.ID)
+		fmt.Printf("Height: %d\n", entry.Height)
+		fmt.Printf("Timestamp: %s\n", time.Unix(entry.Timestamp, 0).Format(time.RFC3339))
+		fmt.Printf("Direction: %s\n", direction)
+		fmt.Printf("Amount: %+d\n", entry.Amount())
+		for _, out := range entry.Counterparty {
+			fmt.Printf("  %d to %s\n", out.Value, wallet.PubKeyHashToAddress(out.PubKeyHash))
+		}
+		fmt.Println()
+	}
+
+	return nil
 }
 
-func (cli *CommandLine) send(from, to string, amount int) {
-	chain := blockchain.ContinueBlockChain(from)
+func (cli *CommandLine) send(from, to string, amount, fee int, mineNow bool) error {
+	if err := validateAddress(to); err != nil {
+		return err
+	}
+	if err := validateAddress(from); err != nil {
+		return err
+	}
+	chain, err := blockchain.ContinueBlockChain(cli.config, from)
+	if err != nil {
+		return err
+	}
 	defer chain.Database.Close()
 
-	tx := blockchain.NewTransaction(from, to, amount, chain)
-	chain.AddBlock([]*blockchain.Transaction{tx})
+	// the sender's private key is needed to sign the transaction
+	wallets, err := wallet.CreateWallets(cli.config.Dir())
+	if err != nil {
+		return err
+	}
+	w := wallets.GetWallet(from)
+	if w == nil {
+		return fmt.Errorf("no wallet found for %s", from)
+	}
+
+	UTXOSet := blockchain.UTXOSet{Blockchain: chain}
+
+	tx, err := blockchain.NewTransaction(w, to, amount, fee, &UTXOSet)
+	if err != nil {
+		return err
+	}
+
+	// the transaction waits in the mempool until a block is mined
+	pool := blockchain.Mempool{Blockchain: chain}
+	if err := pool.Add(tx); err != nil {
+		return err
+	}
+	fmt.Printf("Transaction %x added to the mempool\n", tx.ID)
+
+	if mineNow {
+		// the sender mines the block, and gets the reward
+		if err := cli.mineBlock(chain, from, blockchain.MaxBlockSize); err != nil {
+			return err
+		}
+	}
+
 	fmt.Println("Success!")
+	return nil
 }
 
-func (cli *CommandLine) run() {
-	cli.validateArgs()
+func (cli *CommandLine) mine(address string, maxSize int) error {
+	if err := validateAddress(address); err != nil {
+		return err
+	}
+	chain, err := blockchain.ContinueBlockChain(cli.config, address)
+	if err != nil {
+		return err
+	}
+	defer chain.Database.Close()
+
+	return cli.mineBlock(chain, address, maxSize)
+}
+
+// mines a block with transactions from the mempool and a coinbase paying
+// address the reward and their fees
+func (cli *CommandLine) mineBlock(chain *blockchain.BlockChain, address string, maxSize int) error {
+	pool := blockchain.Mempool{Blockchain: chain}
+	txs, fees, err := pool.BlockTemplate(maxSize)
+	if err != nil {
+		return err
+	}
+
+	// the block goes on top of the tip
+	height, err := chain.GetBestHeight()
+	if err != nil {
+		return err
+	}
+
+	cbTx, err := blockchain.CoinbaseTx(address, "", height+1, fees)
+	if err != nil {
+		return err
+	}
+	// the coinbase always goes first
+	txs = append([]*blockchain.Transaction{cbTx}, txs...)
+
+	// ctrl-c stops the mining instead of killing the process
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	// the last progress call comes when mining ends, it holds the totals
+	var last blockchain.MiningProgress
+	opts := blockchain.MiningOptions{Progress: func(p blockchain.MiningProgress) {
+		last = p
+		fmt.Printf("\rMining... %d hashes, best %x", p.Tried, p.BestHash)
+	}}
+	err = chain.AddBlockContext(ctx, txs, opts)
+	fmt.Println()
+	if err != nil {
+		return fmt.Errorf("block was not mined: %w", err)
+	}
+
+	rate := float64(last.Tried) / last.Elapsed.Seconds()
+	fmt.Printf("Mined %x in %s (%.0f hashes/s)\n", chain.LastHash, last.Elapsed.Round(time.Millisecond), rate)
+	fmt.Printf("Mined a block with %d transactions from the mempool, %d in fees\n", len(txs)-1, fees)
+	return nil
+}
+
+func (cli *CommandLine) supply() error {
+	chain, err := blockchain.ContinueBlockChain(cli.config, "")
+	if err != nil {
+		return err
+	}
+	defer chain.Database.Close()
+
+	height, err := chain.GetBestHeight()
+	if err != nil {
+		return err
+	}
+
+	UTXOSet := blockchain.UTXOSet{Blockchain: chain}
+	circulating, err := UTXOSet.TotalValue()
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Height: %d\n", height)
+	fmt.Printf("Circulating supply: %d\n", circulating)
+	// what the blocks so far were allowed to make, miners may have taken less
+	fmt.Printf("Issued by schedule: %d\n", blockchain.IssuedSupply(height+1))
+	fmt.Printf("Max supply: %d\n", blockchain.MaxSupply)
+	fmt.Printf("Next block reward: %d\n", blockchain.Subsidy(height+1))
+	return nil
+}
+
+func (cli *CommandLine) verifyChain(level int) error {
+	chain, err := blockchain.ContinueBlockChain(cli.config, "")
+	if err != nil {
+		return err
+	}
+	defer chain.Database.Close()
+
+	checked, err := chain.VerifyChain(level)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Chain is valid: %d blocks checked at level %d\n", checked, level)
+	return nil
+}
+
+func (cli *CommandLine) migrate() error {
+	chain, err := blockchain.ContinueBlockChain(cli.config, "")
+	if err != nil {
+		return err
+	}
+	defer chain.Database.Close()
+
+	rewritten, dropped, err := chain.Migrate()
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Done! Rewrote %d blocks and UTXO entries in the new encoding.\n", rewritten)
+	if dropped > 0 {
+		fmt.Printf("Dropped %d transactions from the mempool, send them again.\n", dropped)
+	}
+	return nil
+}
+
+func (cli *CommandLine) printMempool() error {
+	chain, err := blockchain.ContinueBlockChain(cli.config, "")
+	if err != nil {
+		return err
+	}
+	defer chain.Database.Close()
+
+	pool := blockchain.Mempool{Blockchain: chain}
+	txs, err := pool.Transactions()
+	if err != nil {
+		return err
+	}
+
+	for _, tx := range txs {
+		fmt.Printf("%x\n", tx.ID)
+	}
+	fmt.Printf("%d transactions waiting\n", len(txs))
+	return nil
+}
+
+func (cli *CommandLine) createWallet() error {
+	wallets, err := wallet.CreateWallets(cli.config.Dir()) // a missing wallet file just means no wallets yet
+	if err != nil {
+		return err
+	}
+	address, err := wallets.AddWallet() // make a new key pair
+	if err != nil {
+		return err
+	}
+	if err := wallets.SaveFile(); err != nil {
+		return err
+	}
+
+	fmt.Printf("New address is: %s\n", address)
+	return nil
+}
+
+func (cli *CommandLine) reindexUTXO() error {
+	chain, err := blockchain.ContinueBlockChain(cli.config, "")
+	if err != nil {
+		return err
+	}
+	defer chain.Database.Close()
+
+	// the height and address indexes first, chains made before them don't have them
+	if err := chain.ReindexBlocks(); err != nil {
+		return err
+	}
+
+	UTXOSet := blockchain.UTXOSet{Blockchain: chain}
+	if err := UTXOSet.Reindex(); err != nil { // rebuild the index from the blocks
+		return err
+	}
+
+	count, err := UTXOSet.CountTransactions()
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Done! There are %d transactions in the UTXO set.\n", count)
+	return nil
+}
+
+func (cli *CommandLine) listAddresses() error {
+	wallets, err := wallet.CreateWallets(cli.config.Dir())
+	if err != nil {
+		return err
+	}
+	addresses := wallets.GetAllAddresses()
+
+	for _, address := range addresses {
+		fmt.Println(address)
+	}
+	return nil
+}
+
+func (cli *CommandLine) exportAddress(address string) error {
+	wallets, err := wallet.CreateWallets(cli.config.Dir())
+	if err != nil {
+		return err
+	}
+	w := wallets.GetWallet(address)
+	if w == nil {
+		return fmt.Errorf("no wallet found for %s", address)
+	}
+
+	// only the public half is printed, the private key never leaves the wallet file
+	fmt.Printf("Address: %s\n", address)
+	fmt.Printf("Public key: %x\n", w.PublicKey)
+	return nil
+}
+
+func (cli *CommandLine) run() error {
+	// global flags come before the command
+	defaults := blockchain.DefaultConfig()
+	flag.StringVar(&cli.config.DataDir, "datadir", defaults.DataDir, "Directory the chain data is stored in")
+	flag.StringVar(&cli.config.Network, "network", defaults.Network, "Name of the chain, each network is kept apart")
+	flag.BoolVar(&cli.config.TxIndex, "txindex", defaults.TxIndex, "Index transactions by id as blocks are added, older blocks are indexed when it is first on")
+	flag.Usage = cli.printUsage
+	flag.Parse()
+
+	args := flag.Args()
+	if err := cli.validateArgs(args); err != nil {
+		return err
+	}
 
 	// flags, essentially specific strings that if typed into the cli
 	// something is run
 	getBalanceCmd := flag.NewFlagSet("getbalance", flag.ExitOnError)
+	historyCmd := flag.NewFlagSet("history", flag.ExitOnError)
 	createBlockchainCmd := flag.NewFlagSet("createblockchain", flag.ExitOnError)
 	sendCmd := flag.NewFlagSet("send", flag.ExitOnError)
+	mineCmd := flag.NewFlagSet("mine", flag.ExitOnError)
+	mempoolCmd := flag.NewFlagSet("mempool", flag.ExitOnError)
+	supplyCmd := flag.NewFlagSet("supply", flag.ExitOnError)
 	printChainCmd := flag.NewFlagSet("printchain", flag.ExitOnError)
+	printBlockCmd := flag.NewFlagSet("printblock", flag.ExitOnError)
+	getTransactionCmd := flag.NewFlagSet("gettransaction", flag.ExitOnError)
+	createWalletCmd := flag.NewFlagSet("createwallet", flag.ExitOnError)
+	listAddressesCmd := flag.NewFlagSet("listaddresses", flag.ExitOnError)
+	reindexUTXOCmd := flag.NewFlagSet("reindexutxo", flag.ExitOnError)
+	verifyChainCmd := flag.NewFlagSet("verifychain", flag.ExitOnError)
+	migrateCmd := flag.NewFlagSet("migrate", flag.ExitOnError)
+	exportAddressCmd := flag.NewFlagSet("exportaddress", flag.ExitOnError)
 
 	getBalanceAddress := getBalanceCmd.String("address", "", "The address to get balance for")
+	historyAddress := historyCmd.String("address", "", "The address to list transactions for")
+	historyPage := historyCmd.Int("page", 1, "Page of the history to show, 1 is the newest")
+	historyPageSize := historyCmd.Int("pagesize", 10, "Transactions per page")
 	createBlockchainAddress := createBlockchainCmd.String("address", "", "The address to send genesis block reward to")
+	createBlockchainMaturity := createBlockchainCmd.Int("maturity", defaults.CoinbaseMaturity, "Blocks a coinbase has to be buried under before it is spent, kept with the chain")
 	sendFrom := sendCmd.String("from", "", "Source wallet address")
 	sendTo := sendCmd.String("to", "", "Destination wallet address")
 	sendAmount := sendCmd.Int("amount", 0, "Amount to send")
+	sendFee := sendCmd.Int("fee", 0, "Fee paid to the miner")
+	sendMine := sendCmd.Bool("mine", false, "Mine a block right away, rewarding the sender")
+	mineAddress := mineCmd.String("address", "", "The address to send the block reward to")
+	mineMaxSize := mineCmd.Int("maxsize", blockchain.MaxBlockSize, "Most bytes of transactions to take from the mempool")
+	verifyLevel := verifyChainCmd.Int("level", blockchain.VerifyUTXO, "How thorough the checks are, 1 is quickest")
+	exportAddress := exportAddressCmd.String("address", "", "The address to export")
+	printChainFrom := printChainCmd.Int("from", -1, "Height to start printing at")
+	printChainTo := printChainCmd.Int("to", -1, "Height to stop printing at")
+	printBlockHeight := printBlockCmd.Int("height", -1, "Height of the block to print")
+	printBlockHash := printBlockCmd.String("hash", "", "Hash of the block to print")
+	getTransactionID := getTransactionCmd.String("id", "", "ID of the transaction to print")
 
 	// check flags
-	switch os.Args[1] {
+	switch args[0] {
 	case "getbalance":
-		err := getBalanceCmd.Parse(os.Args[2:]) // parses any other arguments after "add"
+		err := getBalanceCmd.Parse(args[1:]) // parses any other arguments after "add"
 		if err != nil {
-			log.Panic(err)
+			return err
+		}
+
+	case "history":
+		err := historyCmd.Parse(args[1:])
+		if err != nil {
+			return err
 		}
 
 	case "createblockchain":
-		err := createBlockchainCmd.Parse(os.Args[2:])
+		err := createBlockchainCmd.Parse(args[1:])
 		if err != nil {
-			log.Panic(err)
+			return err
 		}
 
 	case "printchain":
-		err := printChainCmd.Parse(os.Args[2:])
+		err := printChainCmd.Parse(args[1:])
+		if err != nil {
+			return err
+		}
+
+	case "printblock":
+		err := printBlockCmd.Parse(args[1:])
 		if err != nil {
-			log.Panic(err)
+			return err
+		}
+
+	case "gettransaction":
+		err := getTransactionCmd.Parse(args[1:])
+		if err != nil {
+			return err
 		}
 
 	case "send":
-		err := sendCmd.Parse(os.Args[2:])
+		err := sendCmd.Parse(args[1:])
+		if err != nil {
+			return err
+		}
+
+	case "mine":
+		err := mineCmd.Parse(args[1:])
+		if err != nil {
+			return err
+		}
+
+	case "mempool":
+		err := mempoolCmd.Parse(args[1:])
+		if err != nil {
+			return err
+		}
+
+	case "supply":
+		err := supplyCmd.Parse(args[1:])
+		if err != nil {
+			return err
+		}
+
+	case "createwallet":
+		err := createWalletCmd.Parse(args[1:])
+		if err != nil {
+			return err
+		}
+
+	case "reindexutxo":
+		err := reindexUTXOCmd.Parse(args[1:])
+		if err != nil {
+			return err
+		}
+
+	case "verifychain":
+		err := verifyChainCmd.Parse(args[1:])
+		if err != nil {
+			return err
+		}
+
+	case "migrate":
+		err := migrateCmd.Parse(args[1:])
 		if err != nil {
-			log.Panic(err)
+			return err
+		}
+
+	case "listaddresses":
+		err := listAddressesCmd.Parse(args[1:])
+		if err != nil {
+			return err
+		}
+
+	case "exportaddress":
+		err := exportAddressCmd.Parse(args[1:])
+		if err != nil {
+			return err
 		}
 
 	default:
 		cli.printUsage()
-		runtime.Goexit()
+		return errUsage
 	}
 
 	// .Parsed checks if a flag has been parsed or not
@@ -138,39 +760,121 @@ func (cli *CommandLine) run() {
 		// checks for valid values
 		if *getBalanceAddress == "" {
 			getBalanceCmd.Usage()
-			runtime.Goexit()
+			return errUsage
 		}
-		cli.getBalance(*getBalanceAddress)
+		return cli.getBalance(*getBalanceAddress)
+	}
+
+	if historyCmd.Parsed() {
+		if *historyAddress == "" || *historyPage < 1 || *historyPageSize < 1 {
+			historyCmd.Usage()
+			return errUsage
+		}
+		return cli.history(*historyAddress, *historyPage, *historyPageSize)
 	}
 
 	if createBlockchainCmd.Parsed() {
 		// checks for valid values
-		if *createBlockchainAddress == "" {
+		if *createBlockchainAddress == "" || *createBlockchainMaturity < 1 {
 			createBlockchainCmd.Usage()
-			runtime.Goexit()
+			return errUsage
 		}
-		cli.createBlockChain(*createBlockchainAddress)
+		cli.config.CoinbaseMaturity = *createBlockchainMaturity
+		return cli.createBlockChain(*createBlockchainAddress)
 	}
 
 	if printChainCmd.Parsed() {
-		cli.printChain()
+		return cli.printChain(*printChainFrom, *printChainTo)
+	}
+
+	if printBlockCmd.Parsed() {
+		// exactly one of height or hash
+		if (*printBlockHeight < 0) == (*printBlockHash == "") {
+			printBlockCmd.Usage()
+			return errUsage
+		}
+		return cli.printBlock(*printBlockHeight, *printBlockHash)
+	}
+
+	if getTransactionCmd.Parsed() {
+		if *getTransactionID == "" {
+			getTransactionCmd.Usage()
+			return errUsage
+		}
+		return cli.getTransaction(*getTransactionID)
 	}
 
 	if sendCmd.Parsed() {
 		// checks for valid values
-		if *sendFrom == "" || *sendTo == "" || *sendAmount <= 0 {
+		if *sendFrom == "" || *sendTo == "" || *sendAmount <= 0 || *sendFee < 0 {
 			sendCmd.Usage()
-			runtime.Goexit()
+			return errUsage
+		}
+
+		return cli.send(*sendFrom, *sendTo, *sendAmount, *sendFee, *sendMine)
+	}
+
+	if mineCmd.Parsed() {
+		if *mineAddress == "" || *mineMaxSize <= 0 {
+			mineCmd.Usage()
+			return errUsage
 		}
+		return cli.mine(*mineAddress, *mineMaxSize)
+	}
+
+	if mempoolCmd.Parsed() {
+		return cli.printMempool()
+	}
+
+	if supplyCmd.Parsed() {
+		return cli.supply()
+	}
+
+	if createWalletCmd.Parsed() {
+		return cli.createWallet()
+	}
 
-		cli.send(*sendFrom, *sendTo, *sendAmount)
+	if reindexUTXOCmd.Parsed() {
+		return cli.reindexUTXO()
 	}
+
+	if verifyChainCmd.Parsed() {
+		if *verifyLevel < blockchain.VerifyHeaders || *verifyLevel > blockchain.VerifyUTXO {
+			verifyChainCmd.Usage()
+			return errUsage
+		}
+		return cli.verifyChain(*verifyLevel)
+	}
+
+	if migrateCmd.Parsed() {
+		return cli.migrate()
+	}
+
+	if listAddressesCmd.Parsed() {
+		return cli.listAddresses()
+	}
+
+	if exportAddressCmd.Parsed() {
+		if *exportAddress == "" {
+			exportAddressCmd.Usage()
+			return errUsage
+		}
+		return cli.exportAddress(*exportAddress)
+	}
+
+	return nil
 }
 
 func main() {
-	defer os.Exit(0)     // prevents unexpected exit
 	cli := CommandLine{} // create the cli struct
-	cli.run()            // run the cli struct
+
+	// run the cli struct, and turn any error into a message and exit code
+	if err := cli.run(); err != nil {
+		if !errors.Is(err, errUsage) { // the usage was already printed
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		}
+		os.Exit(exitCode(err))
+	}
 }
 
 // a blockchain's hash value is always dependent on the value
@@ -0,0 +1,66 @@
+package wallet
+
+import (
+	"bytes"
+	"math/big"
+)
+
+// base58 is base64 without the characters that are easy to mix up
+// (0, O, I, l) and without + and /
+const base58Alphabet = "123456789ABCDEFGHJKLMNPQRSTUVWXYZabcdefghijkmnopqrstuvwxyz"
+
+func Base58Encode(input []byte) []byte {
+	var encoded []byte
+
+	num := new(big.Int).SetBytes(input)
+	base := big.NewInt(int64(len(base58Alphabet)))
+	zero := big.NewInt(0)
+	mod := new(big.Int)
+
+	// keep dividing by 58, the remainders are the digits
+	for num.Cmp(zero) != 0 {
+		num.DivMod(num, base, mod)
+		encoded = append(encoded, base58Alphabet[mod.Int64()])
+	}
+
+	// leading zero bytes would be lost in the number, so
+	// each one is written as the first character instead
+	for _, b := range input {
+		if b != 0x00 {
+			break
+		}
+		encoded = append(encoded, base58Alphabet[0])
+	}
+
+	// the digits were added least significant first
+	for i, j := 0, len(encoded)-1; i < j; i, j = i+1, j-1 {
+		encoded[i], encoded[j] = encoded[j], encoded[i]
+	}
+
+	return encoded
+}
+
+// returns nil if input has a character outside of the alphabet
+func Base58Decode(input []byte) []byte {
+	num := big.NewInt(0)
+	base := big.NewInt(int64(len(base58Alphabet)))
+
+	zeros := 0
+	for zeros < len(input) && input[zeros] == base58Alphabet[0] {
+		zeros++
+	}
+
+	for _, char := range input[zeros:] {
+		digit := bytes.IndexByte([]byte(base58Alphabet), char)
+		if digit < 0 {
+			return nil
+		}
+		num.Mul(num, base)
+		num.Add(num, big.NewInt(int64(digit)))
+	}
+
+	decoded := num.Bytes()
+	decoded = append(bytes.Repeat([]byte{0x00}, zeros), decoded...)
+
+	return decoded
+}
@@ -0,0 +1,123 @@
+package wallet
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+
+	"golang.org/x/crypto/ripemd160"
+)
+
+var ErrInvalidAddress = errors.New("address is not valid")
+
+const (
+	checksumLength = 4          // bytes of the checksum at the end of an address
+	version        = byte(0x00) // the first byte of every address
+)
+
+// a wallet is just a key pair. the private key signs
+// transactions, the public key lets others verify them
+type Wallet struct {
+	PrivateKey ecdsa.PrivateKey
+	PublicKey  []byte
+}
+
+// generates a new P-256 private key and the matching public key
+func NewKeyPair() (ecdsa.PrivateKey, []byte, error) {
+	curve := elliptic.P256() // the elliptic curve our keys live on
+
+	private, err := ecdsa.GenerateKey(curve, rand.Reader)
+	if err != nil {
+		return ecdsa.PrivateKey{}, nil, err
+	}
+
+	pub := PublicKeyBytes(&private.PublicKey)
+	return *private, pub, nil
+}
+
+// the public key in bytes is the X and Y coordinates joined together,
+// each padded to 32 bytes so the halves can be split apart again
+func PublicKeyBytes(pub *ecdsa.PublicKey) []byte {
+	key := make([]byte, 64)
+	pub.X.FillBytes(key[:32])
+	pub.Y.FillBytes(key[32:])
+
+	return key
+}
+
+func MakeWallet() (*Wallet, error) {
+	private, public, err := NewKeyPair()
+	if err != nil {
+		return nil, err
+	}
+	wallet := Wallet{private, public}
+
+	return &wallet, nil
+}
+
+// hashes the public key, first with sha256 then with ripemd160.
+// outputs are locked to this hash instead of the full public key
+func PublicKeyHash(pubKey []byte) []byte {
+	pubHash := sha256.Sum256(pubKey)
+
+	hasher := ripemd160.New()
+	hasher.Write(pubHash[:]) // writing to a hash never returns an error
+
+	return hasher.Sum(nil)
+}
+
+// the first 4 bytes of a double sha256 of the payload
+func Checksum(payload []byte) []byte {
+	firstHash := sha256.Sum256(payload)
+	secondHash := sha256.Sum256(firstHash[:])
+
+	return secondHash[:checksumLength]
+}
+
+// an address is version + public key hash + checksum, base58 encoded
+func (w Wallet) Address() []byte {
+	pubHash := PublicKeyHash(w.PublicKey)
+
+	return PubKeyHashToAddress(pubHash)
+}
+
+// builds the address for a public key hash, like the ones outputs are locked to
+func PubKeyHashToAddress(pubHash []byte) []byte {
+	versionedHash := append([]byte{version}, pubHash...)
+	checksum := Checksum(versionedHash)
+
+	fullHash := append(versionedHash, checksum...)
+	address := Base58Encode(fullHash)
+
+	return address
+}
+
+// checks the version byte and that the checksum matches the rest of the address,
+// which catches typos before any coins get sent to them
+func ValidateAddress(address string) bool {
+	fullHash := Base58Decode([]byte(address))
+	if len(fullHash) != 1+ripemd160.Size+checksumLength {
+		return false
+	}
+
+	actualChecksum := fullHash[len(fullHash)-checksumLength:]
+	versionByte := fullHash[0]
+	pubKeyHash := fullHash[1 : len(fullHash)-checksumLength]
+	targetChecksum := Checksum(append([]byte{versionByte}, pubKeyHash...))
+
+	return versionByte == version && bytes.Equal(actualChecksum, targetChecksum)
+}
+
+// strips the version and checksum off of an address
+func AddressToPubKeyHash(address string) ([]byte, error) {
+	if !ValidateAddress(address) {
+		return nil, fmt.Errorf("%w: %s", ErrInvalidAddress, address)
+	}
+	fullHash := Base58Decode([]byte(address))
+
+	return fullHash[1 : len(fullHash)-checksumLength], nil
+}
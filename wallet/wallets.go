@@ -0,0 +1,124 @@
+package wallet
+
+import (
+	"bytes"
+	"crypto/x509"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+const walletFile = "wallets.data"
+
+// all the wallets this node knows about, keyed by address
+type Wallets struct {
+	Wallets map[string]*Wallet
+	file    string // where the wallets are saved
+}
+
+// loads the wallets from the wallet file in dir. a missing file
+// just means no wallets yet, any other error is returned so a
+// damaged file is never saved over
+func CreateWallets(dir string) (*Wallets, error) {
+	wallets := Wallets{}
+	wallets.Wallets = make(map[string]*Wallet)
+	wallets.file = filepath.Join(dir, walletFile)
+
+	err := wallets.LoadFile()
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, fmt.Errorf("loading %s: %w", wallets.file, err)
+	}
+
+	return &wallets, nil
+}
+
+// makes a new wallet, stores it and returns its address
+func (ws *Wallets) AddWallet() (string, error) {
+	wallet, err := MakeWallet()
+	if err != nil {
+		return "", err
+	}
+	address := string(wallet.Address())
+
+	ws.Wallets[address] = wallet
+
+	return address, nil
+}
+
+// returns every address stored in the wallet file
+func (ws *Wallets) GetAllAddresses() []string {
+	var addresses []string
+
+	for address := range ws.Wallets {
+		addresses = append(addresses, address)
+	}
+	sort.Strings(addresses) // map order is random, keep the listing stable
+
+	return addresses
+}
+
+// returns nil if this node doesn't hold the address
+func (ws Wallets) GetWallet(address string) *Wallet {
+	return ws.Wallets[address]
+}
+
+func (ws *Wallets) LoadFile() error {
+	if _, err := os.Stat(ws.file); os.IsNotExist(err) {
+		return err
+	}
+
+	fileContent, err := os.ReadFile(ws.file)
+	if err != nil {
+		return err
+	}
+
+	// the file holds each private key in DER form, keyed by address
+	var keys map[string][]byte
+	decoder := gob.NewDecoder(bytes.NewReader(fileContent))
+	err = decoder.Decode(&keys)
+	if err != nil {
+		return err
+	}
+
+	for address, der := range keys {
+		private, err := x509.ParseECPrivateKey(der)
+		if err != nil {
+			return err
+		}
+		// rebuild the wallet from the private key
+		ws.Wallets[address] = &Wallet{*private, PublicKeyBytes(&private.PublicKey)}
+	}
+
+	return nil
+}
+
+func (ws *Wallets) SaveFile() error {
+	var content bytes.Buffer
+
+	keys := make(map[string][]byte)
+	for address, wallet := range ws.Wallets {
+		der, err := x509.MarshalECPrivateKey(&wallet.PrivateKey)
+		if err != nil {
+			return err
+		}
+		keys[address] = der
+	}
+
+	encoder := gob.NewEncoder(&content)
+	err := encoder.Encode(keys)
+	if err != nil {
+		return err
+	}
+
+	err = os.MkdirAll(filepath.Dir(ws.file), 0755)
+	if err != nil {
+		return err
+	}
+
+	// only the owner should be able to read private keys
+	return os.WriteFile(ws.file, content.Bytes(), 0600)
+}
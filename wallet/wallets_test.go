@@ -0,0 +1,95 @@
+package wallet
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestWalletsRoundTrip(t *testing.T) {
+	dir := t.TempDir()
+
+	// no file yet is no wallets, not an error
+	wallets, err := CreateWallets(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(wallets.GetAllAddresses()) != 0 {
+		t.Fatal("a new wallet file isn't empty")
+	}
+
+	address, err := wallets.AddWallet()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ValidateAddress(address) {
+		t.Errorf("%s is not a valid address", address)
+	}
+	if err := wallets.SaveFile(); err != nil {
+		t.Fatal(err)
+	}
+
+	loaded, err := CreateWallets(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := loaded.GetWallet(address)
+	if w == nil {
+		t.Fatalf("%s was not loaded", address)
+	}
+	if string(w.Address()) != address {
+		t.Errorf("loaded key has address %s, want %s", w.Address(), address)
+	}
+}
+
+// a damaged wallet file is an error, so it doesn't get saved over
+func TestCorruptWalletFile(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, walletFile)
+
+	if err := os.WriteFile(file, []byte("not a wallet file"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := CreateWallets(dir); err == nil {
+		t.Fatal("loaded a corrupt wallet file")
+	}
+
+	content, err := os.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(content) != "not a wallet file" {
+		t.Error("the corrupt wallet file was changed")
+	}
+}
+
+// a typo or an address for another version must not pass as valid
+func TestValidateAddress(t *testing.T) {
+	w, err := MakeWallet()
+	if err != nil {
+		t.Fatal(err)
+	}
+	address := string(w.Address())
+	if !ValidateAddress(address) {
+		t.Fatalf("%s is not a valid address", address)
+	}
+
+	// change one character to another one of the alphabet
+	typo := []byte(address)
+	if typo[5] == '2' {
+		typo[5] = '3'
+	} else {
+		typo[5] = '2'
+	}
+	if ValidateAddress(string(typo)) {
+		t.Errorf("%s with a typo is valid", typo)
+	}
+
+	// a correct checksum over the wrong version byte
+	versioned := append([]byte{0x05}, PublicKeyHash(w.PublicKey)...)
+	other := string(Base58Encode(append(versioned, Checksum(versioned)...)))
+	if ValidateAddress(other) {
+		t.Errorf("%s with version 0x05 is valid", other)
+	}
+}